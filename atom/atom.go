@@ -0,0 +1,91 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package atom defines XML data structures for an Atom feed.
+// It is a copy of code.google.com/p/rsc/blog/atom, extended with
+// the elements and attributes used by the blog.
+package atom
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// ITunesNamespace is the namespace of the iTunes podcast extensions.
+const ITunesNamespace = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+
+type Feed struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Link    []Link   `xml:"link"`
+	Updated TimeStr  `xml:"updated"`
+	Author  *Person  `xml:"author"`
+	Icon    string   `xml:"icon,omitempty"`
+	Logo    string   `xml:"logo,omitempty"`
+	Rights  string   `xml:"rights,omitempty"`
+
+	// iTunes podcast extensions; ITunesNS is set to ITunesNamespace when they are used.
+	ITunesNS       string          `xml:"xmlns:itunes,attr,omitempty"`
+	ITunesAuthor   string          `xml:"itunes:author,omitempty"`
+	ITunesCategory *ITunesCategory `xml:"itunes:category"`
+	ITunesExplicit string          `xml:"itunes:explicit,omitempty"`
+
+	Entry []*Entry `xml:"entry"`
+}
+
+type ITunesCategory struct {
+	Text string `xml:"text,attr"`
+}
+
+type Entry struct {
+	Lang      string  `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Title     string  `xml:"title"`
+	ID        string  `xml:"id"`
+	Link      []Link  `xml:"link"`
+	Published TimeStr `xml:"published,omitempty"`
+	Updated   TimeStr `xml:"updated"`
+	Author    *Person `xml:"author"`
+	Summary   *Text   `xml:"summary"`
+	Content   *Text   `xml:"content"`
+	Rights    *Text   `xml:"rights,omitempty"`
+
+	Category []Category `xml:"category"`
+
+	ITunesEpisode int `xml:"itunes:episode,omitempty"`
+	ITunesSeason  int `xml:"itunes:season,omitempty"`
+}
+
+type Category struct {
+	Term   string `xml:"term,attr"`
+	Scheme string `xml:"scheme,attr,omitempty"`
+}
+
+type Link struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr,omitempty"`
+
+	Hreflang string `xml:"hreflang,attr,omitempty"`
+
+	Length int64 `xml:"length,attr,omitempty"`
+}
+
+type Person struct {
+	Name     string `xml:"name"`
+	URI      string `xml:"uri,omitempty"`
+	Email    string `xml:"email,omitempty"`
+	InnerXML string `xml:",innerxml"`
+}
+
+type Text struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type TimeStr string
+
+func Time(t time.Time) TimeStr {
+	return TimeStr(t.Format("2006-01-02T15:04:05-07:00"))
+}
@@ -1,11 +1,17 @@
 package blog
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"appengine"
 	"appengine/memcache"
+	"appengine/user"
 
 	// The appfs server, running on AppEngine, reads the user and password from the file "/.password" within appfs.
 	_ "code.google.com/p/rsc/appfs/server"
@@ -14,7 +20,10 @@ import (
 	"mime"
 )
 
+var config *post.Config
+
 func Start(cfg *post.Config) {
+	config = cfg
 	mime.AddExtensionType("ttf", "font/truetype")
 	http.HandleFunc("/admin/", Admin)
 	post.Start(cfg)
@@ -22,6 +31,11 @@ func Start(cfg *post.Config) {
 
 func Admin(w http.ResponseWriter, req *http.Request) {
 	c := appengine.NewContext(req)
+	if !user.IsAdmin(c) && !basicAuth(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Blog Admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
 	switch req.FormValue("op") {
 	default:
 		fmt.Fprintf(w, "unknown op %s\n", req.FormValue("op"))
@@ -32,7 +46,30 @@ func Admin(w http.ResponseWriter, req *http.Request) {
 			fmt.Fprintf(w, "ERROR: %s\n", err)
 			return
 		}
+		if req.FormValue("pretty") == "1" {
+			writePretty(w, item.Value)
+			return
+		}
 		w.Write(item.Value)
+	case "memcache-import":
+		if req.Method != "POST" {
+			http.Error(w, "memcache-import requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		var values map[string][]byte // Values are base64 in JSON
+		if err := json.NewDecoder(req.Body).Decode(&values); err != nil {
+			http.Error(w, "ERROR: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		post.ImportCache(req, values)
+		fmt.Fprintf(w, "imported %d keys\n", len(values))
+	case "memcache-export":
+		values, truncated := post.ExportCache(req, 1000)
+		if truncated {
+			w.Header().Set("X-Blog-Export-Truncated", "true")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(values)
 	case "memcache-delete":
 		key := req.FormValue("key")
 		if err := memcache.Delete(c, key); err != nil {
@@ -40,5 +77,161 @@ func Admin(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		fmt.Fprintf(w, "deleted %s\n", key)
+	case "notify-publish":
+		name := req.FormValue("name")
+		if err := post.NotifyPublish(req, name); err != nil {
+			fmt.Fprintf(w, "ERROR: %s\n", err)
+			return
+		}
+		fmt.Fprintf(w, "notified %s\n", name)
+	case "blogcache-dump":
+		data, err := post.ReadBlogCache(req)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %s\n", err)
+			return
+		}
+		writePretty(w, data)
+	case "blogcache-rebuild":
+		n, err := post.RebuildBlogCache(req)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %s\n", err)
+			return
+		}
+		fmt.Fprintf(w, "rebuilt blogcache with %d posts\n", n)
+	case "post-create":
+		if req.Method != "POST" {
+			http.Error(w, "post-create requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		np := &post.NewPost{
+			Name:   req.FormValue("name"),
+			Title:  req.FormValue("title"),
+			Date:   req.FormValue("date"),
+			Author: req.FormValue("author"),
+			Body:   req.FormValue("body"),
+		}
+		if tags := req.FormValue("tags"); tags != "" {
+			for _, t := range strings.Split(tags, ",") {
+				np.Tags = append(np.Tags, strings.TrimSpace(t))
+			}
+		}
+		url, err := post.CreatePost(req, np)
+		if err != nil {
+			http.Error(w, "ERROR: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", url)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s\n", url)
+	case "post-update":
+		if req.Method != "POST" {
+			http.Error(w, "post-update requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		// Fields are told apart from absent ones, so look them up in PostForm,
+		// which ParseMultipartForm also fills for multipart/form-data bodies.
+		if err := req.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+			http.Error(w, "ERROR: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		up := &post.PostUpdate{}
+		for field, p := range map[string]**string{"title": &up.Title, "date": &up.Date, "summary": &up.Summary, "body": &up.Body} {
+			if v, ok := req.PostForm[field]; ok {
+				*p = &v[0]
+			}
+		}
+		if tags, ok := req.PostForm["tags"]; ok {
+			up.Tags = []string{}
+			for _, t := range strings.Split(tags[0], ",") {
+				if t = strings.TrimSpace(t); t != "" {
+					up.Tags = append(up.Tags, t)
+				}
+			}
+		}
+		meta, err := post.UpdatePost(req, req.FormValue("name"), up)
+		if err != nil {
+			http.Error(w, "ERROR: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(meta)
+	case "memcache-stats":
+		stats, err := memcache.Stats(c)
+		if err != nil {
+			http.Error(w, "ERROR: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"hits":            stats.Hits,
+			"misses":          stats.Misses,
+			"byte_hits":       stats.ByteHits,
+			"items":           stats.Items,
+			"bytes":           stats.Bytes,
+			"oldest_item_age": fmt.Sprintf("%ds", stats.Oldest),
+		})
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	case "export-zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename=blog-export-"+time.Now().Format("2006-01-02")+".zip")
+		if err := post.ExportZip(w, req); err != nil {
+			// The archive is already partially written; all we can do is log.
+			c.Criticalf("export-zip: %v", err)
+		}
+	case "export-metadata":
+		format := req.FormValue("format")
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		if err := post.ExportMetadata(w, req, format); err != nil {
+			// The export is already partially written; all we can do is log.
+			c.Criticalf("export-metadata: %v", err)
+		}
+	case "memcache-flush-prefix":
+		prefix := req.FormValue("prefix")
+		if prefix == "" {
+			fmt.Fprintf(w, "ERROR: missing prefix\n")
+			return
+		}
+		n, err := post.FlushCachePrefix(c, prefix)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %s\n", err)
+			return
+		}
+		fmt.Fprintf(w, "flushed %d keys with prefix %s\n", n, prefix)
+	}
+}
+
+// basicAuth reports whether req carries the admin credentials
+// admin:{Config.AdminPassword} in HTTP Basic Auth.
+func basicAuth(req *http.Request) bool {
+	if config.AdminPassword == "" {
+		return false
+	}
+	u, p, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(u), []byte("admin")) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(p), []byte(config.AdminPassword)) == 1
+	return userOK && passOK
+}
+
+// writePretty writes data re-indented if it is valid JSON.
+// Anything else is written unchanged, flagged by the X-Blog-Pretty header.
+func writePretty(w http.ResponseWriter, data []byte) {
+	if !json.Valid(data) {
+		w.Header().Set("X-Blog-Pretty", "skipped")
+		w.Write(data)
+		return
 	}
+	var buf bytes.Buffer
+	json.Indent(&buf, data, "", "\t") // Cannot fail on valid JSON
+	buf.WriteByte('\n')
+	w.Write(buf.Bytes())
 }
@@ -0,0 +1,281 @@
+package post
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/rsc/appfs/fs"
+
+	ae "appengine"
+	"appengine/memcache"
+)
+
+// validPostName matches the file names of posts created through the admin interface.
+var validPostName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// NewPost holds the fields of a post created through the admin interface.
+type NewPost struct {
+	Name   string // File name in the posts directory
+	Title  string
+	Date   string // In one of the timeFormats
+	Author string
+	Tags   []string
+	Body   string // Article HTML
+}
+
+// newPostHeader is the JSON metadata header written for a NewPost.
+type newPostHeader struct {
+	Title  string
+	Date   string   `json:",omitempty"`
+	Author string   `json:",omitempty"`
+	Tags   []string `json:",omitempty"`
+}
+
+// CreatePost writes a new post file and returns the URL of the post.
+// It fails if a post with the same name already exists.
+func CreatePost(req *http.Request, np *NewPost) (string, error) {
+	if !validPostName.MatchString(np.Name) {
+		return "", fmt.Errorf("invalid post name %q", np.Name)
+	}
+	if np.Title == "" {
+		return "", errors.New("missing title")
+	}
+	if np.Date != "" {
+		var t blogTime
+		if err := t.UnmarshalJSON([]byte(strconv.Quote(np.Date))); err != nil {
+			return "", err
+		}
+	}
+
+	c := fs.NewContext(req)
+	name := path.Join(postsDir(), np.Name) + config.PostFileExtension
+	if _, _, err := c.Read(name); err == nil {
+		return "", fmt.Errorf("post %s already exists", np.Name)
+	}
+	hdr, err := json.MarshalIndent(&newPostHeader{
+		Title:  np.Title,
+		Date:   np.Date,
+		Author: np.Author,
+		Tags:   np.Tags,
+	}, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	data := append(hdr, '\n')
+	data = append(data, np.Body...)
+	if err := c.Write(name, data); err != nil {
+		return "", err
+	}
+	if _, err := FlushCachePrefix(ae.NewContext(req), "blog:toc:"); err != nil {
+		c.Criticalf("flush toc cache: %v", err)
+	}
+	return hostURL(req) + "/" + path.Join(postsDir(), np.Name), nil
+}
+
+// PostUpdate holds the fields of a post changed through the admin interface.
+// Nil fields are left unchanged.
+type PostUpdate struct {
+	Title   *string
+	Date    *string // In one of the timeFormats; empty removes the date
+	Summary *string
+	Tags    []string
+	Body    *string // Article HTML
+}
+
+// UpdatePost rewrites the supplied fields of the post name, keeping the rest
+// of its JSON header, and returns the updated metadata.
+// A memcache lock rejects concurrent updates of the same post.
+func UpdatePost(req *http.Request, name string, up *PostUpdate) (*PostData, error) {
+	if !validPostName.MatchString(name) {
+		return nil, fmt.Errorf("invalid post name %q", name)
+	}
+	if up.Date != nil && *up.Date != "" {
+		var t blogTime
+		if err := t.UnmarshalJSON([]byte(strconv.Quote(*up.Date))); err != nil {
+			return nil, err
+		}
+	}
+
+	ac := ae.NewContext(req)
+	lock := "blog:lock:" + name
+	if err := memcache.Add(ac, &memcache.Item{Key: lock, Value: []byte("1"), Expiration: 30 * time.Second}); err != nil {
+		return nil, fmt.Errorf("post %s is being updated: %v", name, err)
+	}
+	defer memcache.Delete(ac, lock)
+
+	c := fs.NewContext(req)
+	file := path.Join(postsDir(), name) + config.PostFileExtension
+	data, _, err := c.Read(file)
+	if err != nil {
+		return nil, err
+	}
+	hdr := map[string]json.RawMessage{}
+	body := data
+	if bytes.HasPrefix(data, []byte("{\n")) {
+		i := bytes.Index(data, []byte("\n}\n"))
+		if i < 0 {
+			return nil, errors.New("cannot find end of json metadata")
+		}
+		if err := json.Unmarshal(data[:i+3], &hdr); err != nil {
+			return nil, fmt.Errorf("loading %s: %s", name, err)
+		}
+		body = data[i+3:]
+	}
+	set := func(field string, v interface{}) {
+		raw, _ := json.Marshal(v)
+		hdr[field] = raw
+	}
+	if up.Title != nil {
+		set("Title", *up.Title)
+	}
+	if up.Date != nil {
+		if *up.Date == "" {
+			delete(hdr, "Date") // Back to an undated draft
+		} else {
+			set("Date", *up.Date)
+		}
+	}
+	if up.Summary != nil {
+		set("Summary", *up.Summary)
+	}
+	if up.Tags != nil {
+		set("Tags", up.Tags)
+	}
+	if up.Body != nil {
+		body = []byte(*up.Body)
+	}
+
+	var out []byte
+	if len(hdr) > 0 { // loadPost takes "{}" for article text
+		out, err = json.MarshalIndent(hdr, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, '\n')
+	}
+	out = append(out, body...)
+	if err := c.Write(file, out); err != nil {
+		return nil, err
+	}
+	// The write also invalidates the pages of the posts showing this one's metadata,
+	// since all pages are cached under cacheRoot(), which holds the posts.
+	key := "bloghtml:" + path.Join("/", postsDir(), name)
+	if err := flushCacheKeys(ac, []string{key}); err != nil {
+		c.Criticalf("flush %s: %v", key, err)
+	}
+	for _, prefix := range []string{"blog:toc:", "blog:atomfeed", "blog:podcastfeed"} {
+		if _, err := FlushCachePrefix(ac, prefix); err != nil {
+			c.Criticalf("flush %s: %v", prefix, err)
+		}
+	}
+
+	meta, _, err := loadPost(WithFsContext(req.Context(), c), path.Join(postsDir(), name), req)
+	return meta, err
+}
+
+// ExportMetadata writes the metadata of all posts, drafts included, to w
+// as a JSON array, or as CSV if format is "csv".
+// The Google+ API key and the reader lists are left out.
+func ExportMetadata(w io.Writer, req *http.Request, format string) error {
+	c := fs.NewContext(req)
+	dir, err := readPostDir(c)
+	if err != nil {
+		return err
+	}
+	posts := loadAllPosts(WithFsContext(req.Context(), c), req, dir)
+
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"Name", "Title", "Date", "Author", "Tags", "Status", "WordCount", "ViewCount"})
+		for _, meta := range posts {
+			status := "published"
+			if meta.IsDraft() {
+				status = "draft"
+			}
+			var date string
+			if !meta.Date.IsZero() {
+				date = meta.Date.Format("2006-01-02")
+			}
+			// View counts are not recorded by the blog; the column is kept for the fixed layout.
+			cw.Write([]string{meta.Name, meta.Title, date, meta.Author, strings.Join(meta.Tags, ","), status, strconv.Itoa(meta.WordCount), ""})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	if _, err := io.WriteString(w, "[\n"); err != nil {
+		return err
+	}
+	for i, meta := range posts {
+		fields, err := postFields(meta)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			data = append([]byte(",\n"), data...)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "\n]\n")
+	return err
+}
+
+// ExportZip writes a zip archive of the posts, templates, static files
+// and blogcache to w. Files that cannot be read are logged and skipped.
+func ExportZip(w io.Writer, req *http.Request) error {
+	c := fs.NewContext(req)
+	var names []string
+	for _, dir := range []string{postsDir(), "blog/static"} {
+		files, err := readDirEllipses(c, dir, postDirMaxDepth())
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+	}
+	names = append(names, templatePath("main.html"), templatePath("style.html"), templatePath("atom.html"))
+
+	z := zip.NewWriter(w)
+	add := func(name string, data []byte) error {
+		f, err := z.Create(strings.TrimPrefix(name, "/"))
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+	for _, name := range names {
+		data, _, err := c.Read(name)
+		if err != nil {
+			c.Criticalf("export %s: %v", name, err)
+			continue
+		}
+		if err := add(name, data); err != nil {
+			return err
+		}
+	}
+	if data, _, err := c.Read("blogcache"); err == nil {
+		if err := add("blogcache.json", data); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
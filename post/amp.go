@@ -0,0 +1,62 @@
+package post
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"path"
+
+	"code.google.com/p/rsc/appfs/fs"
+)
+
+// amp serves the AMP (Accelerated Mobile Pages) rendition of published posts at /amp/{name}.
+func amp(w http.ResponseWriter, req *http.Request) {
+	c := fs.NewContext(req)
+	ctx := WithFsContext(req.Context(), c)
+	p := path.Clean("/" + req.URL.Path)
+	if p == "/amp" { // No post name; redirecting to /amp would bounce back to /amp/
+		notfound(c, w, req, newRequestID())
+		return
+	}
+	if p != req.URL.Path {
+		http.Redirect(w, req, config.BasePathPrefix+p, http.StatusFound)
+		return
+	}
+	p = p[len("/amp"):]
+
+	var data []byte
+	if key, ok := cacheLoad(req, c, "blogamp:"+p, &data); !ok {
+		meta, article, err := loadPost(ctx, p, req)
+		if err != nil || meta.IsDraft() {
+			c.Criticalf("no amp %s", p)
+			notfound(c, w, req, newRequestID())
+			return
+		}
+		meta.DraftNote = "" // Not for readers
+		t := ampTemplate(c)
+		template.Must(t.New("article").Parse(article))
+
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, meta); err != nil {
+			panic(err)
+		}
+		data = buf.Bytes()
+		cacheStore(req, c, key, "blogamp:"+p, data)
+	}
+	w.Write(data)
+}
+
+func ampTemplate(c *fs.Context) *template.Template {
+	t := template.New("amp")
+	t.Funcs(funcMap)
+
+	amp, _, err := c.Read(templatePath("amp.html"))
+	if err != nil {
+		panic(err)
+	}
+	_, err = t.Parse(string(amp))
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
@@ -0,0 +1,32 @@
+package post
+
+import (
+	"fmt"
+	"html/template"
+	"regexp"
+
+	ae "appengine"
+)
+
+// validAnalyticsID matches GA4 measurement IDs, e.g. "G-XXXXXXXX".
+var validAnalyticsID = regexp.MustCompile(`^G-[A-Z0-9]+$`)
+
+// analyticsSnippet returns the Google Analytics 4 snippet for the page head,
+// or nothing if Config.AnalyticsID is unset or malformed.
+// On the development server, page views are logged to the console instead.
+func analyticsSnippet() template.HTML {
+	id := config.AnalyticsID
+	if !validAnalyticsID.MatchString(id) {
+		return ""
+	}
+	if ae.IsDevAppServer() {
+		return template.HTML(fmt.Sprintf(`<script>console.log("analytics: page view for %s");</script>`, id))
+	}
+	return template.HTML(fmt.Sprintf(`<script async src="https://www.googletagmanager.com/gtag/js?id=%[1]s"></script>
+<script>
+window.dataLayer = window.dataLayer || [];
+function gtag(){dataLayer.push(arguments);}
+gtag('js', new Date());
+gtag('config', '%[1]s');
+</script>`, id))
+}
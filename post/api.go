@@ -0,0 +1,249 @@
+package post
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"code.google.com/p/rsc/appfs/fs"
+)
+
+// GetPost returns the metadata of the post name.
+// The appfs context is taken from ctx, see WithFsContext.
+func GetPost(ctx context.Context, name string) (*PostData, error) {
+	if _, ok := FsContextFromContext(ctx); !ok {
+		return nil, errors.New("no appfs context")
+	}
+	meta, _, err := loadPost(ctx, name, nil)
+	return meta, err
+}
+
+// ListPosts returns the posts listed in the table of contents, sorted chronologically.
+// If draft is set, drafts are included as well.
+// The appfs context is taken from ctx, see WithFsContext.
+func ListPosts(ctx context.Context, draft bool) ([]*PostData, error) {
+	c, ok := FsContextFromContext(ctx)
+	if !ok {
+		return nil, errors.New("no appfs context")
+	}
+	dir, err := readPostDir(c)
+	if err != nil {
+		return nil, err
+	}
+	return loadPosts(ctx, nil, dir, draft, true, ""), nil
+}
+
+// cors sets the CORS headers of the API response to req for the origins in Config.CORSAllowedOrigins.
+// It answers OPTIONS preflight requests itself and then reports false.
+func cors(w http.ResponseWriter, req *http.Request) bool {
+	if origin := req.Header.Get("Origin"); origin != "" {
+		for _, o := range config.CORSAllowedOrigins {
+			if o == "*" {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				break
+			}
+			if o == origin {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+				break
+			}
+		}
+	}
+	if req.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	return true
+}
+
+// apiPageSize is the number of posts returned per page by the JSON API.
+const apiPageSize = 20
+
+// ApiTocData is the JSON counterpart of TocData served at /api/toc.
+type ApiTocData struct {
+	User    string // Set in draft mode only, since public responses are shared
+	Draft   bool
+	HostURL string
+	Page    int               // 1-based page number
+	Pages   int               // Total number of pages
+	Posts   []json.RawMessage // See apiPost
+}
+
+// postFields returns the JSON fields of meta,
+// leaving out the Google+ API key and the reader lists.
+func postFields(meta *PostData) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "PlusAPIKey")
+	delete(fields, "Reader")
+	return fields, nil
+}
+
+// apiPost returns the JSON form of meta served by the API.
+// It is that of postFields, except that ReadingLevel is named reading_level.
+func apiPost(meta *PostData) json.RawMessage {
+	fields, err := postFields(meta)
+	if err != nil {
+		panic(err)
+	}
+	if l, ok := fields["ReadingLevel"]; ok {
+		delete(fields, "ReadingLevel")
+		fields["reading_level"] = l
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func apiPosts(posts []*PostData) []json.RawMessage {
+	r := []json.RawMessage{}
+	for _, meta := range posts {
+		r = append(r, apiPost(meta))
+	}
+	return r
+}
+
+// apitoc serves the post index as JSON.
+// Supported form values: draft=1 (owner only), tag, author, lang, level and page.
+func apitoc(w http.ResponseWriter, req *http.Request) {
+	if !cors(w, req) {
+		return
+	}
+	c := fs.NewContext(req)
+	ctx := WithFsContext(req.Context(), c)
+	user := c.User()
+	isOwner := ownerRequest(c, req)
+
+	draft := req.FormValue("draft") == "1"
+	if draft && !isOwner {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	page, _ := strconv.Atoi(req.FormValue("page"))
+	if page < 1 {
+		page = 1
+	}
+	tag, author, lang, level := req.FormValue("tag"), req.FormValue("author"), req.FormValue("lang"), req.FormValue("level")
+
+	// Key schema: "blog:apitoc:{draft},tag={tag},author={author},lang={lang},level={level},page={page}[,user={user}]"
+	keystr := fmt.Sprintf("blog:apitoc:%v,tag=%s,author=%s,lang=%s,level=%s,page=%d", draft, tag, author, lang, level, page)
+	if draft {
+		keystr += ",user=" + user
+	}
+
+	var data []byte
+	if key, ok := cacheLoad(req, c, keystr, &data); !ok {
+		dir, err := readPostDir(c)
+		if err != nil {
+			panic(err)
+		}
+		var posts []*PostData
+		for _, meta := range loadPosts(ctx, req, dir, draft, isOwner, user) {
+			if !draft && meta.IsDraft() { // Drafts shared with user; the key does not name user
+				continue
+			}
+			if tag != "" && !meta.hasTag(tag) {
+				continue
+			}
+			if author != "" && meta.Author != author {
+				continue
+			}
+			if lang != "" && meta.Language != lang {
+				continue
+			}
+			if level != "" && meta.ReadingLevel != level {
+				continue
+			}
+			posts = append(posts, meta)
+		}
+
+		if !draft {
+			posts = withoutDraftNotes(posts)
+		}
+		r := &ApiTocData{
+			Draft:   draft,
+			HostURL: hostURL(req),
+			Page:    page,
+			Pages:   (len(posts) + apiPageSize - 1) / apiPageSize,
+		}
+		if draft {
+			r.User = user
+		}
+		if i := (page - 1) * apiPageSize; i < len(posts) {
+			posts = posts[i:]
+			if len(posts) > apiPageSize {
+				posts = posts[:apiPageSize]
+			}
+			r.Posts = apiPosts(posts)
+		}
+		if data, err = json.Marshal(r); err != nil {
+			panic(err)
+		}
+		cacheStore(req, c, key, keystr, data)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// apidrafts serves the drafts as a JSON array, to the owner only.
+// Supported form values: since (RFC 3339), selecting drafts modified after that time,
+// and scheduled=1, selecting drafts with a publication date in the future.
+func apidrafts(w http.ResponseWriter, req *http.Request) {
+	if !cors(w, req) {
+		return
+	}
+	c := fs.NewContext(req)
+	ctx := WithFsContext(req.Context(), c)
+	if !ownerRequest(c, req) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	var since time.Time
+	if s := req.FormValue("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "bad since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	scheduled := req.FormValue("scheduled") == "1"
+
+	dir, err := readPostDir(c)
+	if err != nil {
+		panic(err)
+	}
+	var drafts []*PostData
+	now := time.Now()
+	for _, meta := range loadAllPosts(ctx, req, dir) {
+		if !meta.IsDraft() {
+			continue
+		}
+		if !since.IsZero() && !meta.ModTime().After(since) {
+			continue
+		}
+		if scheduled && !meta.Date.After(now) {
+			continue
+		}
+		drafts = append(drafts, meta)
+	}
+	data, err := json.Marshal(apiPosts(drafts))
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,303 @@
+package post
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ae "appengine"
+	"appengine/memcache"
+
+	"code.google.com/p/rsc/appfs/fs"
+)
+
+// The appfs does not keep a CacheLoad entry under its name: it derives the
+// memcache key from the name and the version of the scope path, which changes
+// whenever a file in that scope is written. Deleting the names from memcache
+// would therefore flush nothing. Instead, the entries the blog may flush are
+// loaded through cacheLoad, which scopes them to cacheRoot() and qualifies
+// their names with generations kept in memcache. Flushing a name gives it
+// a new generation, so that its next load misses.
+
+// keyIndex is the memcache key holding the JSON-encoded list
+// of all cache names stored by cacheStore.
+const keyIndex = "blog:keyindex"
+
+// maxIndexedKeys bounds the cache key index, which must fit in one memcache item.
+const maxIndexedKeys = 5000
+
+// keyIndexFull is the memcache key set when a name could not be indexed.
+// The next flush then discards all entries, since it cannot tell which match.
+const keyIndexFull = "blog:keyindex:full"
+
+// genKey is the memcache key of the generation of all entries,
+// and genKey+name that of the entry name.
+const genKey = "blog:gen:"
+
+var errKeyIndexBusy = errors.New("cache key index is busy")
+
+func newGeneration() []byte {
+	return []byte(strconv.FormatInt(time.Now().UnixNano(), 36))
+}
+
+// cacheName returns the name under which cacheLoad looks up the entry name.
+func cacheName(c ae.Context, name string) string {
+	items, err := memcache.GetMulti(c, []string{genKey, genKey + name})
+	if err != nil {
+		// Miss rather than risk serving a flushed entry.
+		c.Criticalf("load generation of %s: %v", name, err)
+		return name + "#" + string(newGeneration())
+	}
+	var g, k []byte
+	if item := items[genKey]; item != nil {
+		g = item.Value
+	}
+	if item := items[genKey+name]; item != nil {
+		k = item.Value
+	}
+	if g == nil && k == nil {
+		return name
+	}
+	return name + "#" + string(g) + "." + string(k)
+}
+
+// cacheLoad is fs.Context.CacheLoad for an entry the blog can flush.
+func cacheLoad(req *http.Request, c *fs.Context, name string, value interface{}) (fs.CacheKey, bool) {
+	return c.CacheLoad(cacheName(ae.NewContext(req), name), cacheRoot(), value)
+}
+
+// cacheStore stores value under key, as returned by cacheLoad for name,
+// and then records name in the cache key index.
+func cacheStore(req *http.Request, c *fs.Context, key fs.CacheKey, name string, value interface{}) {
+	c.CacheStore(key, value)
+	indexCacheKey(ae.NewContext(req), name)
+}
+
+func loadKeyIndex(c ae.Context) []string {
+	var keys []string
+	item, err := memcache.Get(c, keyIndex)
+	if err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(item.Value, &keys); err != nil {
+		c.Criticalf("unmarshal %s: %v", keyIndex, err)
+		return nil
+	}
+	return keys
+}
+
+// updateKeyIndex replaces the cache key index with the result of f,
+// unless f returns false. It retries if the index changed meanwhile.
+func updateKeyIndex(c ae.Context, f func(keys []string) ([]string, bool)) error {
+	for try := 0; try < 3; try++ {
+		var keys []string
+		item, err := memcache.Get(c, keyIndex)
+		if err == memcache.ErrCacheMiss {
+			item = nil
+		} else if err != nil {
+			return err
+		} else if err := json.Unmarshal(item.Value, &keys); err != nil {
+			c.Criticalf("unmarshal %s: %v", keyIndex, err)
+			keys = nil
+		}
+		keys, ok := f(keys)
+		if !ok {
+			return nil
+		}
+		data, err := json.Marshal(keys)
+		if err != nil {
+			panic(err)
+		}
+		if item == nil {
+			err = memcache.Add(c, &memcache.Item{Key: keyIndex, Value: data})
+		} else {
+			item.Value = data
+			err = memcache.CompareAndSwap(c, item)
+		}
+		if err != memcache.ErrNotStored && err != memcache.ErrCASConflict {
+			return err
+		}
+	}
+	return errKeyIndexBusy
+}
+
+// indexCacheKey records names in the cache key index, so that they can later be
+// flushed by FlushCachePrefix. Names that do not fit are flagged by keyIndexFull.
+func indexCacheKey(c ae.Context, names ...string) {
+	var full bool
+	err := updateKeyIndex(c, func(keys []string) ([]string, bool) {
+		indexed := map[string]bool{}
+		for _, k := range keys {
+			indexed[k] = true
+		}
+		n := len(keys)
+		full = false
+		for _, name := range names {
+			if indexed[name] {
+				continue
+			}
+			if len(keys) >= maxIndexedKeys {
+				full = true
+				break
+			}
+			indexed[name] = true
+			keys = append(keys, name)
+		}
+		return keys, len(keys) > n
+	})
+	if err != nil {
+		c.Criticalf("index %v: %v", names, err)
+		full = true
+	}
+	if full {
+		if err := memcache.Set(c, &memcache.Item{Key: keyIndexFull, Value: []byte("1")}); err != nil {
+			c.Criticalf("store %s: %v", keyIndexFull, err)
+		}
+	}
+}
+
+// FlushCachePrefix flushes all indexed cache names starting with prefix,
+// in batches of 100, and returns the number of names flushed.
+// If some names could not be indexed, it flushes every entry.
+func FlushCachePrefix(c ae.Context, prefix string) (int, error) {
+	return flushCache(c, func(k string) bool { return strings.HasPrefix(k, prefix) })
+}
+
+// flushCacheKeys flushes the cache names listed in keys.
+func flushCacheKeys(c ae.Context, keys []string) error {
+	set := map[string]bool{}
+	for _, k := range keys {
+		set[k] = true
+	}
+	_, err := flushCache(c, func(k string) bool { return set[k] })
+	return err
+}
+
+// flushCache gives new generations to the indexed cache names for which match
+// returns true, drops them from the index, and returns their number.
+func flushCache(c ae.Context, match func(string) bool) (int, error) {
+	var flush []string
+	for _, k := range loadKeyIndex(c) {
+		if match(k) {
+			flush = append(flush, k)
+		}
+	}
+	gen := newGeneration()
+	if _, err := memcache.Get(c, keyIndexFull); err == nil {
+		// Unindexed names may match too.
+		if err := memcache.Set(c, &memcache.Item{Key: genKey, Value: gen}); err != nil {
+			return 0, err
+		}
+		memcache.Delete(c, keyIndexFull)
+		return len(flush), updateKeyIndex(c, func([]string) ([]string, bool) { return nil, true })
+	}
+	const batch = 100
+	for i := 0; i < len(flush); i += batch {
+		j := i + batch
+		if j > len(flush) {
+			j = len(flush)
+		}
+		var items []*memcache.Item
+		for _, k := range flush[i:j] {
+			items = append(items, &memcache.Item{Key: genKey + k, Value: gen})
+		}
+		if err := memcache.SetMulti(c, items); err != nil {
+			return i, err
+		}
+	}
+	return len(flush), updateKeyIndex(c, func(keys []string) ([]string, bool) {
+		var keep []string
+		for _, k := range keys {
+			if !match(k) {
+				keep = append(keep, k)
+			}
+		}
+		return keep, true
+	})
+}
+
+// statsKey is the memcache key holding the JSON-encoded TocStats of the public TOC.
+const statsKey = "blog:stats"
+
+func storeStats(req *http.Request, stats *TocStats) {
+	c := ae.NewContext(req)
+	data, err := json.Marshal(stats)
+	if err != nil {
+		panic(err)
+	}
+	if err := memcache.Set(c, &memcache.Item{Key: statsKey, Value: data}); err != nil {
+		c.Criticalf("store %s: %v", statsKey, err)
+	}
+}
+
+// LoadStats returns the statistics of the public TOC as of its last rebuild.
+func LoadStats(req *http.Request) (*TocStats, error) {
+	item, err := memcache.Get(ae.NewContext(req), statsKey)
+	if err != nil {
+		return nil, err
+	}
+	stats := new(TocStats)
+	if err := json.Unmarshal(item.Value, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ReadBlogCache returns the raw contents of the "/blogcache" file.
+func ReadBlogCache(req *http.Request) ([]byte, error) {
+	data, _, err := fs.NewContext(req).Read("blogcache")
+	return data, err
+}
+
+// RebuildBlogCache discards "/blogcache", rebuilds it from all posts,
+// flushes the cached post HTML and returns the number of posts found.
+func RebuildBlogCache(req *http.Request) (int, error) {
+	c := fs.NewContext(req)
+	if err := c.Remove("blogcache"); err != nil {
+		c.Criticalf("remove blogcache: %v", err)
+	}
+	dir, err := readPostDir(c)
+	if err != nil {
+		return 0, err
+	}
+	all := loadPosts(WithFsContext(req.Context(), c), req, dir, true, true, "")
+	if _, err := FlushCachePrefix(ae.NewContext(req), "bloghtml:"); err != nil {
+		return len(all), err
+	}
+	return len(all), nil
+}
+
+// ExportCache returns the cached values of up to limit indexed cache names,
+// as encoded by the appfs, and reports whether names were left out.
+// Names whose entries are gone are skipped.
+func ExportCache(req *http.Request, limit int) (map[string][]byte, bool) {
+	ac, c := ae.NewContext(req), fs.NewContext(req)
+	keys := loadKeyIndex(ac)
+	truncated := len(keys) > limit
+	if truncated {
+		keys = keys[:limit]
+	}
+	r := map[string][]byte{}
+	for _, k := range keys {
+		if _, data, ok := c.CacheRead(cacheName(ac, k), cacheRoot()); ok {
+			r[k] = data
+		}
+	}
+	return r, truncated
+}
+
+// ImportCache stores values, as returned by ExportCache, in the cache
+// and adds their names to the cache key index.
+func ImportCache(req *http.Request, values map[string][]byte) {
+	ac, c := ae.NewContext(req), fs.NewContext(req)
+	var names []string
+	for k, v := range values {
+		key, _, _ := c.CacheRead(cacheName(ac, k), cacheRoot())
+		c.CacheWrite(key, v)
+		names = append(names, k)
+	}
+	indexCacheKey(ac, names...)
+}
@@ -0,0 +1,31 @@
+package post
+
+import (
+	"context"
+
+	"code.google.com/p/rsc/appfs/fs"
+)
+
+// ContextKey is the context.Context key under which the *fs.Context of a request is stored.
+type ContextKey struct{}
+
+// WithFsContext returns a copy of ctx carrying the appfs context c.
+// Callers of GetPost and ListPosts use it to supply the appfs context.
+func WithFsContext(ctx context.Context, c *fs.Context) context.Context {
+	return context.WithValue(ctx, ContextKey{}, c)
+}
+
+// FsContextFromContext returns the appfs context stored in ctx, if any.
+func FsContextFromContext(ctx context.Context) (*fs.Context, bool) {
+	c, ok := ctx.Value(ContextKey{}).(*fs.Context)
+	return c, ok
+}
+
+// mustFsContext is like FsContextFromContext but panics if ctx carries no appfs context.
+func mustFsContext(ctx context.Context) *fs.Context {
+	c, ok := FsContextFromContext(ctx)
+	if !ok {
+		panic("no appfs context")
+	}
+	return c
+}
@@ -0,0 +1,59 @@
+package post
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+)
+
+// demoPlaceholder marks the place of the interactive demo in the article.
+const demoPlaceholder = "[demo]"
+
+// DemoProvider returns the service hosting InteractiveDemo:
+// "codepen", "stackblitz", "jsfiddle", or the empty string if it is not recognized.
+func (d *PostData) DemoProvider() string {
+	u, err := url.Parse(d.InteractiveDemo)
+	if err != nil {
+		return ""
+	}
+	switch strings.TrimPrefix(u.Host, "www.") {
+	case "codepen.io":
+		return "codepen"
+	case "stackblitz.com":
+		return "stackblitz"
+	case "jsfiddle.net":
+		return "jsfiddle"
+	}
+	return ""
+}
+
+// DemoEmbedURL returns the URL of the embeddable version of InteractiveDemo.
+// Demos of unknown providers are embedded as given.
+func (d *PostData) DemoEmbedURL() string {
+	u, err := url.Parse(d.InteractiveDemo)
+	if err != nil {
+		return ""
+	}
+	switch d.DemoProvider() {
+	case "codepen": // https://codepen.io/{user}/pen/{id} -> https://codepen.io/{user}/embed/{id}
+		u.Path = strings.Replace(u.Path, "/pen/", "/embed/", 1)
+	case "stackblitz":
+		q := u.Query()
+		q.Set("embed", "1")
+		u.RawQuery = q.Encode()
+	case "jsfiddle": // https://jsfiddle.net/{user}/{id}/ -> https://jsfiddle.net/{user}/{id}/embedded/
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/embedded/"
+	}
+	return u.String()
+}
+
+// embedDemo replaces the demo placeholders of article with the iframe of the interactive demo of meta.
+func embedDemo(meta *PostData, article string) string {
+	if meta.InteractiveDemo == "" || !strings.Contains(article, demoPlaceholder) {
+		return article
+	}
+	iframe := fmt.Sprintf(`<iframe class="demo" src="%s" width="100%%" height="400" frameborder="0" loading="lazy" allowfullscreen></iframe>`,
+		html.EscapeString(meta.DemoEmbedURL()))
+	return strings.Replace(article, demoPlaceholder, iframe, -1)
+}
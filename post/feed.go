@@ -0,0 +1,95 @@
+package post
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// feedFormat is a feed representation selectable by content negotiation.
+type feedFormat struct {
+	mediaType string
+	serve     func(ctx context.Context, w http.ResponseWriter, req *http.Request)
+}
+
+// feedFormats lists the feed representations in order of preference.
+// Atom comes first: it is served when the Accept header is absent or matches nothing.
+// RSS and JSON feeds slot in here once the blog serves them.
+var feedFormats = []feedFormat{
+	{"application/atom+xml", atomfeed},
+}
+
+// feedHandler serves /feed and /feed.atom in the representation
+// with the highest quality in the Accept header of req.
+func feedHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	w.Header().Add("Vary", "Accept")
+	f, ok := negotiateFeed(req.Header.Get("Accept"))
+	if !ok {
+		http.Error(w, "no acceptable feed format", http.StatusNotAcceptable)
+		return
+	}
+	f.serve(ctx, w, req)
+}
+
+// negotiateFeed returns the feed format preferred by the Accept header accept.
+// Formats accept does not mention are taken over ones it refuses with quality 0.
+// If it refuses all formats, the result is false.
+func negotiateFeed(accept string) (feedFormat, bool) {
+	if accept == "" {
+		return feedFormats[0], true
+	}
+	var best, unmatched *feedFormat
+	bestq := 0.0
+	for i, f := range feedFormats {
+		q := acceptQuality(accept, f.mediaType)
+		if q < 0 && unmatched == nil {
+			unmatched = &feedFormats[i]
+		}
+		if q > bestq {
+			best, bestq = &feedFormats[i], q
+		}
+	}
+	if best == nil {
+		best = unmatched
+	}
+	if best == nil {
+		return feedFormat{}, false
+	}
+	return *best, true
+}
+
+// acceptQuality returns the quality the Accept header accept assigns to mediaType,
+// or -1 if no media range in accept matches it. As in RFC 7231, the quality
+// is that of the most specific matching range.
+func acceptQuality(accept, mediaType string) float64 {
+	major := mediaType[:strings.Index(mediaType, "/")]
+	q, spec := -1.0, 0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		var s int
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case mediaType:
+			s = 3
+		case major + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		default:
+			continue
+		}
+		pq := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					pq = v
+				}
+			}
+		}
+		if s > spec || (s == spec && pq > q) {
+			q, spec = pq, s
+		}
+	}
+	return q
+}
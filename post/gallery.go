@@ -0,0 +1,27 @@
+package post
+
+import (
+	"path"
+	"strings"
+)
+
+// GalleryItem is an image of the gallery of a post.
+type GalleryItem struct {
+	URL          string
+	ThumbnailURL string // The image with "-thumb" before its extension
+	Alt          string // From PostData.ImageAlt
+}
+
+// Gallery returns the GalleryImages of the post with their URLs resolved.
+func (d *PostData) Gallery() []GalleryItem {
+	var r []GalleryItem
+	for _, img := range d.GalleryImages {
+		ext := path.Ext(img)
+		r = append(r, GalleryItem{
+			URL:          staticURL(d.HostURL, img),
+			ThumbnailURL: staticURL(d.HostURL, strings.TrimSuffix(img, ext)+"-thumb"+ext),
+			Alt:          d.ImageAlt[path.Base(img)],
+		})
+	}
+	return r
+}
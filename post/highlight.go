@@ -0,0 +1,38 @@
+package post
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+)
+
+// codeBlockRE matches fenced code blocks as rendered to HTML, capturing the language and the code.
+var codeBlockRE = regexp.MustCompile(`(?s)<pre><code class="language-([\w+#-]+)">(.*?)</code></pre>`)
+
+// highlight replaces the code blocks of article that name a known language
+// with syntax highlighted HTML in the Config.SyntaxHighlightTheme style.
+// Blocks in unknown languages are left alone.
+func highlight(article string) string {
+	style := styles.Get(config.SyntaxHighlightTheme)
+	formatter := chromahtml.New()
+	return codeBlockRE.ReplaceAllStringFunc(article, func(block string) string {
+		m := codeBlockRE.FindStringSubmatch(block)
+		lexer := lexers.Get(m[1])
+		if lexer == nil {
+			return block
+		}
+		it, err := lexer.Tokenise(nil, html.UnescapeString(m[2]))
+		if err != nil {
+			return block
+		}
+		var buf bytes.Buffer
+		if err := formatter.Format(&buf, style, it); err != nil {
+			return block
+		}
+		return buf.String()
+	})
+}
@@ -0,0 +1,28 @@
+package post
+
+// licenses maps SPDX identifiers to the name and URL of the license.
+var licenses = map[string]struct{ name, url string }{
+	"CC-BY-4.0":       {"Creative Commons Attribution 4.0", "https://creativecommons.org/licenses/by/4.0/"},
+	"CC-BY-SA-4.0":    {"Creative Commons Attribution-ShareAlike 4.0", "https://creativecommons.org/licenses/by-sa/4.0/"},
+	"CC-BY-NC-4.0":    {"Creative Commons Attribution-NonCommercial 4.0", "https://creativecommons.org/licenses/by-nc/4.0/"},
+	"CC-BY-NC-SA-4.0": {"Creative Commons Attribution-NonCommercial-ShareAlike 4.0", "https://creativecommons.org/licenses/by-nc-sa/4.0/"},
+	"CC-BY-ND-4.0":    {"Creative Commons Attribution-NoDerivatives 4.0", "https://creativecommons.org/licenses/by-nd/4.0/"},
+	"CC0-1.0":         {"Creative Commons Zero 1.0", "https://creativecommons.org/publicdomain/zero/1.0/"},
+	"MIT":             {"MIT License", "https://opensource.org/licenses/MIT"},
+	"Apache-2.0":      {"Apache License 2.0", "https://www.apache.org/licenses/LICENSE-2.0"},
+	"BSD-3-Clause":    {"BSD 3-Clause License", "https://opensource.org/licenses/BSD-3-Clause"},
+}
+
+// LicenseName returns the human-readable name of License,
+// or License itself if it is not a known SPDX identifier, e.g. "All rights reserved".
+func (d *PostData) LicenseName() string {
+	if l, ok := licenses[d.License]; ok {
+		return l.name
+	}
+	return d.License
+}
+
+// LicenseURL returns the URL of the text of License, or the empty string if it is not known.
+func (d *PostData) LicenseURL() string {
+	return licenses[d.License].url
+}
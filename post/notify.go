@@ -0,0 +1,63 @@
+package post
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+
+	"code.google.com/p/rsc/appfs/fs"
+)
+
+// webhookClient is the shared client for outbound notification calls, created in Start.
+var webhookClient *http.Client
+
+// httpClient returns the client to use for outbound calls made on behalf of ctx.
+func httpClient(ctx context.Context) *http.Client {
+	if config.HTTPClientFactory != nil {
+		return config.HTTPClientFactory(ctx)
+	}
+	return webhookClient
+}
+
+// NotifyPublish announces the published post name on the configured channels.
+// Notification failures are logged and do not fail the publish flow.
+func NotifyPublish(req *http.Request, name string) error {
+	c := fs.NewContext(req)
+	ctx := WithFsContext(req.Context(), c)
+	meta, _, err := loadPost(ctx, name, req)
+	if err != nil {
+		return err
+	}
+	if meta.IsDraft() {
+		return fmt.Errorf("%s is not published", name)
+	}
+	if config.TelegramBotToken != "" && config.TelegramChannelID != "" {
+		if err := notifyTelegram(httpClient(ctx), config.TelegramBotToken, config.TelegramChannelID, meta); err != nil {
+			c.Criticalf("notify telegram %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// notifyTelegram posts the title, summary and URL of post to a Telegram channel
+// using the Bot API sendMessage method. The message uses the HTML parse mode,
+// which, unlike Markdown, can escape everything the title and summary contain.
+func notifyTelegram(client *http.Client, botToken, channelID string, post *PostData) error {
+	esc := html.EscapeString
+	text := fmt.Sprintf("<b>%s</b>\n\n%s\n\n%s", esc(post.Title), esc(post.Summary), esc(post.Canonical()))
+	resp, err := client.PostForm("https://api.telegram.org/bot"+botToken+"/sendMessage", url.Values{
+		"chat_id":    {channelID},
+		"text":       {text},
+		"parse_mode": {"HTML"},
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("telegram sendMessage: %s", resp.Status)
+	}
+	return nil
+}
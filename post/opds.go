@@ -0,0 +1,77 @@
+package post
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	"code.google.com/p/rsc/appfs/fs"
+	"github.com/petar/blog/atom"
+)
+
+// OPDS 1.2 link types
+const (
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsImageRel        = "http://opds-spec.org/image"
+)
+
+// opds serves an OPDS catalog of all published posts, for ebook readers.
+func opds(w http.ResponseWriter, req *http.Request) {
+	c := fs.NewContext(req)
+	ctx := WithFsContext(req.Context(), c)
+
+	var data []byte
+	if key, ok := cacheLoad(req, c, "blog:opds", &data); !ok {
+		all := publishedPosts(ctx, req)
+
+		feed := &atom.Feed{
+			Title: config.OPDSTitle,
+			ID:    config.FeedID + "/opds",
+			Author: &atom.Person{
+				Name:  config.Name,
+				Email: config.Email,
+			},
+			Link: []atom.Link{
+				{Rel: "self", Href: hostURL(req) + "/opds", Type: opdsAcquisitionType},
+				{Rel: "start", Href: hostURL(req) + "/opds", Type: opdsAcquisitionType},
+			},
+		}
+		if len(all) > 0 {
+			feed.Updated = atom.Time(all[0].Date.Time)
+		}
+
+		for _, meta := range all {
+			e := &atom.Entry{
+				Lang:    meta.Language,
+				Title:   meta.Title,
+				ID:      feed.ID + "/" + meta.Name,
+				Updated: atom.Time(meta.Date.Time),
+				Link: []atom.Link{
+					{Rel: "alternate", Href: meta.HostURL + "/" + meta.Name, Type: "text/html"},
+				},
+				Summary: &atom.Text{
+					Type: "text",
+					Body: meta.Summary,
+				},
+			}
+			if meta.CoverImage != "" {
+				e.Link = append(e.Link, atom.Link{Rel: opdsImageRel, Href: meta.CoverImage})
+			}
+			if meta.Author != "" {
+				e.Author = &atom.Person{Name: meta.Author}
+			}
+			feed.Entry = append(feed.Entry, e)
+		}
+
+		var err error
+		data, err = xml.Marshal(&feed)
+		if err != nil {
+			panic(err)
+		}
+		cacheStore(req, c, key, "blog:opds", data)
+	}
+
+	httpCache(w, 15*time.Minute)
+	w.Header().Set("Content-Type", opdsAcquisitionType)
+	w.Write(data)
+}
@@ -0,0 +1,24 @@
+package post
+
+import "strings"
+
+// SocialLink is a social media profile of the blog owner.
+type SocialLink struct {
+	Platform string // e.g. "github"; see platformIcons
+	URL      string
+	Handle   string // Name shown for the profile, e.g. "@jane"
+}
+
+// platformIcons maps well-known platform names to their icon characters.
+var platformIcons = map[string]string{
+	"twitter":  "🐦",
+	"github":   "🐙",
+	"linkedin": "💼",
+	"mastodon": "🐘",
+	"bluesky":  "🦋",
+}
+
+// Icon returns the icon character of the platform of l, or the empty string if it is not well known.
+func (l SocialLink) Icon() string {
+	return platformIcons[strings.ToLower(l.Platform)]
+}
@@ -7,20 +7,32 @@ package post
 import (
 	"bytes"
 	"container/list"
+	"context"
+	"crypto/sha1"
+	"embed"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"log"
+	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
 	"path"
 	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/rsc/appfs/fs"
 	"code.google.com/p/rsc/appfs/proto"
-	"code.google.com/p/rsc/blog/atom"
+	"github.com/petar/blog/atom"
+	"golang.org/x/sync/singleflight"
 
 	ae "appengine"
 	aeu "appengine/user"
@@ -38,22 +50,145 @@ type Config struct {
 	PublicURL string // Public URL of app web site
 	FeedID    string
 	FeedTitle string // Atom feed title
+
+	TwitterHandle string // Twitter handle of owner, without the @
+
+	SocialLinks []SocialLink // Social media profiles of the owner, shown on every page
+
+	FeedIncludeEnclosures bool   // Attach podcast audio enclosures to the main Atom feed
+	FeedAuthorURI         string // Feed author URI; defaults to the Google Plus page of PlusID
+	FeedAuthorEmail       string // Feed author email; defaults to Email
+	FeedImageURL          string // URL of the feed logo image
+	FeedIconURL           string // URL of the feed icon
+	FeedSelfURL           string // Self link of the Atom feed, when served from another public URL
+	FeedCopyright         string // Rights statement of the feeds, e.g. "© 2024 Jane Doe. CC BY 4.0"
+
+	StaticFileMaxAge time.Duration // Cache-Control max-age of static files; zero disables caching
+	StaticFileETag   bool          // Serve content-hash ETags for static files
+
+	PostDirMaxDepth int // Depth limit of subdirectories scanned for posts; 5 if zero, none if negative
+
+	AllowedSchemas []string // Schema.org types allowed in PostData.Schema; defaultSchemas if empty
+
+	EmbedDefaultTemplates  bool          // Fall back to built-in templates when blog/main.html is missing
+	TemplateReloadInterval time.Duration // Reuse parsed templates for this long before checking appfs; zero checks on every use
+
+	PostsDirectory    string // Directory scanned for posts; "blog/post" if empty
+	TemplateDirectory string // Directory of main.html, style.html, atom.html and amp.html; "blog" if empty
+
+	PodcastAuthor   string // iTunes author of the podcast feed
+	PodcastCategory string // iTunes category of the podcast feed, e.g. "Technology"
+	PodcastExplicit bool   // Mark the podcast feed as explicit
+
+	FeedEntryTemplate     string        // Appfs file of the feed entry template; atom.html in TemplateDirectory if empty
+	FeedEntryTemplateHTML template.HTML // Source of the feed entry template; overrides FeedEntryTemplate
+
+	RelatedPostsCount int // Number of related posts shown with a post; 3 if zero
+	SidebarPostCount  int // Number of posts in TocData.SidebarPosts; 5 if zero
+
+	SyntaxHighlight      bool   // Highlight fenced code blocks on the server
+	SyntaxHighlightTheme string // Highlighting style name, e.g. "github"
+
+	AllowedTimeFormats []string // Additional layouts of post dates, e.g. "2006-01-02"
+
+	PostLoadTimeout time.Duration // Time allowed for reading a post file from appfs; 5s if zero
+
+	PostFileExtension string // If set, only files with this extension (e.g. ".post") are posts; it is not part of post URLs
+
+	AdminPassword string // Password of the "admin" user for HTTP Basic Auth to /admin/; disabled if empty
+
+	AMPEnabled bool // Serve AMP versions of posts under /amp/
+
+	BasePathPrefix string // Path the blog is hosted under, e.g. "/blog"; empty for the root
+
+	HTTPSRedirect     bool // Redirect requests with X-Forwarded-Proto: http to HTTPS
+	HTTPSRedirectCode int  // Status of the HTTPS redirect, e.g. 308 to preserve POST; 301 if zero
+
+	RateLimitRPS   float64 // Requests per second allowed per client IP; zero disables rate limiting
+	RateLimitBurst int     // Maximum burst of requests per client IP
+
+	MaxConcurrentRequests int // Requests served at once before replying 503; unlimited if zero
+	StreamThresholdBytes  int // Post files at least this large are streamed while rendering; zero buffers all
+
+	DefaultLanguage string // Language of posts that do not specify one, e.g. "en"
+
+	OPDSEnabled bool   // Serve an OPDS catalog of the posts at /opds
+	OPDSTitle   string // OPDS catalog title
+
+	TelegramBotToken  string // Telegram bot token used to announce published posts
+	TelegramChannelID string // Telegram channel receiving the announcements
+
+	WebhookTimeout    time.Duration                          // Timeout of outbound notification calls; 5s if zero
+	HTTPClientFactory func(ctx context.Context) *http.Client // Client for outbound calls, e.g. urlfetch on AppEngine; optional
+
+	TOCSort string // Order of the TOC: "" (chronological), "favorites-first" or "updated"
+
+	CommentSystem string // Default comment widget: "google-plus", "disqus" or "github-issues"
+
+	DefaultLicense string // License of posts that do not specify one, e.g. "CC-BY-4.0"
+
+	ErrorReportingURL string // Endpoint receiving a JSON PanicReport for each panic recovered in serve
+
+	AnalyticsID string // Google Analytics 4 measurement ID, e.g. "G-XXXXXXXX"
+
+	CORSAllowedOrigins []string // Origins allowed to call /api/ endpoints from browsers; ["*"] allows any
+
+	ListenAddr      string        // Address served by Start outside AppEngine, e.g. ":8080"; Start only registers handlers if empty
+	ShutdownTimeout time.Duration // Grace period of in-flight requests on SIGTERM or SIGINT; 30s if zero
 }
 
 var config *Config
 
+// requestSem holds a ticket for each request in serve, if Config.MaxConcurrentRequests is set.
+var requestSem chan bool
+
 func Start(cfg *Config) {
 	config = cfg
-	http.HandleFunc("/", serve)
-	http.Handle("/feeds/posts/default", http.RedirectHandler("/feed.atom", http.StatusFound))
+	timeout := cfg.WebhookTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	webhookClient = &http.Client{Timeout: timeout}
+	if commonDir(path.Dir(templatePath("main.html")), postsDir()) == "" {
+		log.Printf("blog: templates in %s and posts in %s share no directory; template changes will not invalidate cached pages",
+			path.Dir(templatePath("main.html")), postsDir())
+	}
+	if cfg.MaxConcurrentRequests > 0 {
+		requestSem = make(chan bool, cfg.MaxConcurrentRequests)
+	}
+	handle("/", serve)
+	handle("/api/toc", apitoc)
+	handle("/api/drafts", apidrafts)
+	handle("/api/react", apireact)
+	if cfg.AMPEnabled {
+		handle("/amp/", amp)
+	}
+	if cfg.OPDSEnabled {
+		handle("/opds", opds)
+	}
+	http.Handle(cfg.BasePathPrefix+"/feeds/posts/default", http.RedirectHandler(cfg.BasePathPrefix+"/feed.atom", http.StatusFound))
+
+	// Outside AppEngine, serve until shutdown.
+	if cfg.ListenAddr != "" && !onAppEngine() {
+		if err := listenAndServe(cfg.ListenAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// handle registers f for pattern under the configured base path prefix.
+// Handlers see request paths with the prefix stripped.
+func handle(pattern string, f http.HandlerFunc) {
+	http.Handle(config.BasePathPrefix+pattern, http.StripPrefix(config.BasePathPrefix, f))
 }
 
 var funcMap = template.FuncMap{
-	"eq":     func(x, y string) bool { return x == y },
-	"now":    time.Now,
-	"date":   timeFormat,
-	"join":   path.Join,
-	"logged": func(user string) bool { return user != "?" && user != "" },
+	"eq":      func(x, y string) bool { return x == y },
+	"now":     time.Now,
+	"date":    timeFormat,
+	"join":    path.Join,
+	"logged":  func(user string) bool { return user != "?" && user != "" },
+	"sharing": (*PostData).SharingURLs,
 }
 
 func timeFormat(fmt string, t time.Time) string {
@@ -64,7 +199,8 @@ type blogTime struct {
 	time.Time
 }
 
-// Time formats, tried while parsing the Date field in a post
+// Time formats, tried while parsing the Date field in a post,
+// before Config.AllowedTimeFormats
 var timeFormats = []string{
 	time.RFC3339,
 	"Monday, January 2, 2006",
@@ -73,7 +209,11 @@ var timeFormats = []string{
 
 func (t *blogTime) UnmarshalJSON(data []byte) (err error) {
 	str := string(data)
-	for _, f := range timeFormats {
+	formats := timeFormats
+	if config != nil {
+		formats = append(formats[:len(formats):len(formats)], config.AllowedTimeFormats...)
+	}
+	for _, f := range formats {
 		tt, err := time.Parse(`"`+f+`"`, str)
 		if err == nil {
 			t.Time = tt
@@ -87,15 +227,87 @@ type PostData struct {
 	FileModTime time.Time
 	FileSize    int64
 
-	Title    string
-	Date     blogTime
-	Name     string
-	OldURL   string
-	Summary  string
-	Favorite bool
-	NotInTOC bool
-	Aux      string
-	Author   string
+	Title     string
+	Date      blogTime
+	Name      string
+	OldURL    string
+	Summary   string
+	Favorite  bool
+	NotInTOC  bool
+	NotInFeed bool
+	Aux       string
+	Author    string
+
+	LastModified blogTime // Editorial modification time; overrides FileModTime when set
+	UpdatedDate  blogTime // Date of the last content revision
+
+	CanonicalURL string // URL of the original, for syndicated posts
+	Language     string // Language code of the post, e.g. "en" or "fr"
+	CoverImage   string // URL of the cover image of the post
+	PreviewImage string // URL of a 1200×630 preview image for social networks; defaults to CoverImage
+	Schema       string // Schema.org type of the post for structured data, e.g. "HowTo"
+	Geo          string // Location of the post as "lat,lon", e.g. "37.7749,-122.4194"
+	GeoPlace     string // Name of the location, e.g. "San Francisco, CA"
+
+	ArticleType string // Kind of post, e.g. "article", "note", "link", "photo" or "video"
+
+	ShowInSidebar bool // List the post in the TOC sidebar
+	Noindex       bool // Ask search engines not to index the post; it is still listed in the TOC
+
+	InteractiveDemo string // URL of a CodePen, StackBlitz or JSFiddle demo, embedded at [demo] in the article
+
+	ReadingLevel string `json:",omitempty"` // Intended audience, e.g. "beginner", "intermediate" or "expert"
+
+	HideDate bool // Evergreen page without a publication date; published even if Date is unset
+
+	Changelog []ChangeEntry // Significant revisions of the post
+
+	EstimatedPublishDate blogTime // Announced publication date of a draft, listed under Upcoming in the TOC
+
+	Translations map[string]string // Translated versions by language code, as post names ("/bonjour-monde") or URLs
+
+	SponsoredBy string // Sponsor of the post, disclosed on the page and in feeds
+
+	License string // Content license, an SPDX identifier like "CC-BY-4.0" or free text
+
+	Abstract template.HTML // Longer HTML summary shown atop the post; feeds keep using Summary
+
+	ImageAlt      map[string]string // Alt text of the images of the article, by image file name
+	GalleryImages []string          // Images of the photo gallery of the post, relative to blog/static/
+
+	CustomCSS       string       // Stylesheet of the post, relative to blog/static/, or an absolute URL
+	CustomCSSInline template.CSS // Style rules of the post, for a <style> block
+
+	RelatedPosts []*PostData `json:"-"` // Published posts sharing tags with this one, set when serving
+
+	Analytics template.HTML `json:"-"` // Analytics snippet for the page head, set when serving
+
+	SocialLinks []SocialLink `json:"-"` // Config.SocialLinks, set when serving
+
+	Reactions map[string]int `json:"-"` // Emoji reaction counts as of the render, set when serving; see /api/react
+
+	PrevName string    // Previous post of a series, e.g. "foo" in the posts directory; overrides the chronological neighbor
+	NextName string    // Next post of a series, e.g. "foo" in the posts directory; overrides the chronological neighbor
+	Prev     *PostData `json:"-"` // Previous post, set when serving
+	Next     *PostData `json:"-"` // Next post, set when serving
+
+	DraftNote string // Editorial note of the author, shown in the draft TOC and admin views only
+
+	Deprecation string // Note marking the post as outdated, e.g. "This post is outdated; see /newer-post"
+
+	PodcastAudio    string // URL of the podcast audio (MP3) of the post
+	PodcastDuration string // Duration of the audio, HH:MM:SS
+	PodcastSize     int64  // Size of the audio file in bytes
+
+	PodcastEpisodeNumber int // Episode number in the podcast feed
+	PodcastSeason        int // Season number in the podcast feed
+
+	WordCount      int // Number of words in the article text
+	CharCount      int // Number of characters in the article text
+	CodeBlockCount int // Number of <pre> and <code> blocks in the article
+
+	TableOfContents []TocEntry // The <h2> and <h3> headings of the article
+	Footnotes       []Footnote // The footnotes defined in the article, in order
 
 	Reader []string
 
@@ -104,11 +316,30 @@ type PostData struct {
 	PlusAPIKey string // Google+ API key
 	PlusURL    string
 	HostURL    string // host URL
+	AMPURL     string // URL of the AMP version of the post, if enabled
 	Comments   bool
+	Tags       []string
+	Keywords   []string // Keywords of the meta keywords tag; defaults to Tags
+
+	CommentSystem string // Comment widget of the post; defaults to Config.CommentSystem
+	GHIssueURL    string // GitHub issue used as the comment thread of the post
+
+	TwitterAuthor string // Twitter handle of author for twitter:creator, without the @
 
 	article string
 }
 
+// ChangeEntry is a significant revision of a post.
+type ChangeEntry struct {
+	Date blogTime
+	Note string
+}
+
+// HasChangelog reports whether the post lists any revisions.
+func (d *PostData) HasChangelog() bool {
+	return len(d.Changelog) > 0
+}
+
 func (d *PostData) canRead(user string) bool {
 	for _, r := range d.Reader {
 		if r == user {
@@ -118,7 +349,152 @@ func (d *PostData) canRead(user string) bool {
 	return false
 }
 
+func (d *PostData) hasTag(tag string) bool {
+	for _, t := range d.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ModTime returns the time the post content was last modified:
+// LastModified if given in the post header, otherwise FileModTime,
+// or UpdatedDate if that is later.
+func (d *PostData) ModTime() time.Time {
+	t := d.FileModTime
+	if !d.LastModified.IsZero() {
+		t = d.LastModified.Time
+	}
+	if d.UpdatedDate.After(t) {
+		t = d.UpdatedDate.Time
+	}
+	return t
+}
+
+// Updated returns the date of the last revision of the post:
+// the latest Changelog entry, else UpdatedDate if given, otherwise Date.
+func (d *PostData) Updated() time.Time {
+	var last time.Time
+	for _, ch := range d.Changelog {
+		if ch.Date.After(last) {
+			last = ch.Date.Time
+		}
+	}
+	if !last.IsZero() {
+		return last
+	}
+	if !d.UpdatedDate.IsZero() {
+		return d.UpdatedDate.Time
+	}
+	return d.Date.Time
+}
+
+// Canonical returns the canonical URL of the post:
+// CanonicalURL if given in the post header, otherwise the post URL on this blog.
+func (d *PostData) Canonical() string {
+	if d.CanonicalURL != "" {
+		return d.CanonicalURL
+	}
+	return d.HostURL + "/" + strings.TrimPrefix(d.Name, "/")
+}
+
+// TranslationURLs returns the absolute URLs of the Translations, by language code.
+func (d *PostData) TranslationURLs() map[string]string {
+	if len(d.Translations) == 0 {
+		return nil
+	}
+	r := map[string]string{}
+	for lang, t := range d.Translations {
+		if strings.Contains(t, "://") {
+			r[lang] = t
+		} else {
+			r[lang] = d.HostURL + "/" + strings.TrimPrefix(t, "/")
+		}
+	}
+	return r
+}
+
+// Sponsored reports whether the post is sponsored content.
+func (d *PostData) Sponsored() bool {
+	return d.SponsoredBy != ""
+}
+
+// SponsorName returns the name of the sponsor of the post.
+func (d *PostData) SponsorName() string {
+	return d.SponsoredBy
+}
+
+// PreviewImageURL returns the absolute URL of the social preview image of the post:
+// PreviewImage if given, otherwise CoverImage, or the empty string if neither is set.
+func (d *PostData) PreviewImageURL() string {
+	img := d.PreviewImage
+	if img == "" {
+		img = d.CoverImage
+	}
+	if img == "" || strings.Contains(img, "://") {
+		return img
+	}
+	return d.HostURL + "/" + strings.TrimPrefix(img, "/")
+}
+
+// MetaKeywords returns Keywords joined for the content of the meta keywords tag.
+func (d *PostData) MetaKeywords() string {
+	return strings.Join(d.Keywords, ", ")
+}
+
+// GeoPosition returns the location of the post in the "lat;lon" form of
+// the geo.position meta tag, or the empty string if Geo is not "lat,lon"
+// with a latitude in [-90, 90] and a longitude in [-180, 180].
+// Templates emit Geo itself in the ICBM meta tag.
+func (d *PostData) GeoPosition() string {
+	f := strings.Split(d.Geo, ",")
+	if len(f) != 2 {
+		return ""
+	}
+	lat, lon := strings.TrimSpace(f[0]), strings.TrimSpace(f[1])
+	if x, err := strconv.ParseFloat(lat, 64); err != nil || !(x >= -90 && x <= 90) { // Also rejects NaN
+		return ""
+	}
+	if x, err := strconv.ParseFloat(lon, 64); err != nil || !(x >= -180 && x <= 180) {
+		return ""
+	}
+	return lat + ";" + lon
+}
+
+// MinutesToRead estimates the reading time of the post, at 200 words per minute.
+func (d *PostData) MinutesToRead() int {
+	if m := (d.WordCount + 199) / 200; m > 1 {
+		return m
+	}
+	return 1
+}
+
+// HumanReadingTime returns the reading time of the post as, e.g., "5 mins read".
+func (d *PostData) HumanReadingTime() string {
+	m := d.MinutesToRead()
+	if m == 1 {
+		return "1 min read"
+	}
+	return fmt.Sprintf("%d mins read", m)
+}
+
+// SharingURLs returns links sharing the post on social sites, keyed by site:
+// "twitter", "linkedin", "hackernews" and "reddit".
+func (d *PostData) SharingURLs() map[string]string {
+	u, title := url.QueryEscape(d.Canonical()), url.QueryEscape(d.Title)
+	return map[string]string{
+		"twitter":    "https://twitter.com/intent/tweet?url=" + u + "&text=" + title,
+		"linkedin":   "https://www.linkedin.com/sharing/share-offsite/?url=" + u,
+		"hackernews": "https://news.ycombinator.com/submitlink?u=" + u + "&t=" + title,
+		"reddit":     "https://www.reddit.com/submit?url=" + u + "&title=" + title,
+	}
+}
+
 func (d *PostData) IsDraft() bool {
+	if d.HideDate && d.Date.IsZero() { // Published but undated
+		return false
+	}
 	return d.Date.IsZero() || d.Date.After(time.Now())
 }
 
@@ -150,22 +526,78 @@ var replacer = strings.NewReplacer(
 
 func serve(w http.ResponseWriter, req *http.Request) {
 	ctxt := fs.NewContext(req)
-	ctxt.Criticalf("SERVING %s", req.URL.Path)
+	ctx := WithFsContext(req.Context(), ctxt)
+	reqID := newRequestID()
+	w.Header().Set("X-Request-ID", reqID)
+	ctxt.Criticalf("SERVING %s request=%s", req.URL.Path, reqID)
+
+	// Log the outcome of the request. This covers toc and atomfeed,
+	// which are dispatched from serve.
+	start := time.Now()
+	cw := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	w = cw
+	defer func() {
+		ctxt.Criticalf("SERVED %s status=%d bytes=%d duration=%v", req.URL.Path, cw.status, cw.bytes, time.Since(start))
+	}()
+
+	// ☻ Redirect plain HTTP requests terminated by a proxy to HTTPS
+	if config.HTTPSRedirect && req.Header.Get("X-Forwarded-Proto") == "http" {
+		code := config.HTTPSRedirectCode
+		if code == 0 {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(w, req, "https://"+req.Host+req.RequestURI, code) // req.URL has lost BasePathPrefix
+		return
+	}
+
+	if !rateLimit(w, req) {
+		return
+	}
+	if requestSem != nil {
+		select {
+		case requestSem <- true:
+			defer func() { <-requestSem }()
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests in flight", http.StatusServiceUnavailable)
+			return
+		}
+	}
 
 	// If a panic occurs in the user logic,
 	// catch it, log it and return a 500 error.
+	pc := &panicContext{stage: "route"}
 	defer func() {
 		if err := recover(); err != nil {
 			var buf bytes.Buffer
 			fmt.Fprintf(&buf, "panic: %s\n\n", err)
-			buf.Write(debug.Stack())
-			ctxt.Criticalf("%s", buf.String())
+			stack := debug.Stack()
+			buf.Write(stack)
+			ctxt.Criticalf("request=%s %s %s", reqID, pc, buf.String())
 
 			http.Error(w, buf.String(), 500)
+
+			if config.ErrorReportingURL != "" {
+				// Report in the background, so that the 500 response does not wait on
+				// the reporting endpoint nor the report get canceled with the request.
+				report := PanicReport{
+					Error:     fmt.Sprint(err),
+					Stack:     string(stack),
+					Path:      req.URL.Path,
+					User:      pc.user,
+					Timestamp: time.Now(),
+				}
+				go func() {
+					if rerr := reportPanic(context.WithoutCancel(ctx), config.ErrorReportingURL, report); rerr != nil {
+						ctxt.Criticalf("request=%s report panic: %v", reqID, rerr)
+					}
+				}()
+			}
 		}
 	}()
 
 	p := path.Clean("/" + req.URL.Path)
+	pc.post = p
 
 	// ☻ If the site is accessed via its appspot URL, redirect to the cutsom URL
 	// to make sure links on the site are not broken.
@@ -175,29 +607,36 @@ func serve(w http.ResponseWriter, req *http.Request) {
 
 	// ☻ Correct paths missing the root slash
 	if p != req.URL.Path {
-		http.Redirect(w, req, p, http.StatusFound)
+		http.Redirect(w, req, config.BasePathPrefix+p, http.StatusFound)
 		return
 	}
 
 	// ☻ Serve atom feed requests
-	if p == "/feed.atom" {
-		atomfeed(w, req)
+	if p == "/feed.atom" || p == "/feed" {
+		pc.stage = "feed"
+		feedHandler(ctx, w, req)
+		return
+	}
+	if p == "/feed.podcast.atom" {
+		pc.stage = "feed"
+		podcastfeed(ctx, w, req)
 		return
 	}
 
 	// ☻ Determine whether logged user is guest or owner
 	user := ctxt.User()
-	// isOwner = owner in AppEngine
-	isOwner := aeu.IsAdmin(ae.NewContext(req)) || ctxt.User() == config.Account
+	isOwner := ownerRequest(ctxt, req)
+	pc.user = user
 
 	// ☻ If URL signifies the TOC page
 	if p == "" || p == "/" || p == "/draft" {
 		if p == "/draft" && user == "?" { // ☻ Prevent non-owners from viewing draft TOC pages
 			ctxt.Criticalf("/draft loaded by %s", user)
-			notfound(ctxt, w, req)
+			notfound(ctxt, w, req, reqID)
 			return
 		}
-		toc(w, req, p == "/draft", isOwner, user) // Render
+		pc.stage, pc.draft = "toc", p == "/draft"
+		toc(ctx, w, req, p == "/draft", isOwner, user) // Render
 		return
 	}
 
@@ -206,67 +645,264 @@ func serve(w http.ResponseWriter, req *http.Request) {
 	if strings.HasPrefix(p, "/draft/") {
 		if user == "?" {
 			ctxt.Criticalf("/draft loaded by %s", user)
-			notfound(ctxt, w, req)
+			notfound(ctxt, w, req, reqID)
 			return
 		}
 		draft = true
 		p = p[len("/draft"):]
 	}
+	pc.post, pc.draft = p, draft
 
 	/*
 		// There are no valid URLs with slashes after the root or draft part of the URL.
 		// We disable this, since we would like to be able to serve the whole MathJax tree statically.
 		if strings.Contains(p[1:], "/") {
-			notfound(ctxt, w, req)
+			notfound(ctxt, w, req, reqID)
 			return
 		}
 	*/
 
 	// If the path contains dots, it is interpreted as a static file
 	if strings.Contains(p, ".") {
-		// Let Google's front end servers cache static content for a short amount of time.
+		pc.stage = "static"
+		// Let Google's front end servers cache static content for a configurable amount of time.
 		// httpCache simply adds a caching directive in the HTTP response
-
-		// Disable temporarily while fiddling with CSS files
-		//httpCache(w, 5*time.Minute)
+		if config.StaticFileMaxAge > 0 {
+			httpCache(w, config.StaticFileMaxAge)
+		}
+		if config.StaticFileETag {
+			etag := staticETag(ctxt, "blog/static/"+p)
+			if etag != "" {
+				w.Header().Set("ETag", etag)
+				if req.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+		}
 		ctxt.ServeFile(w, req, "blog/static/"+p)
 		return
 	}
 
-	// Use just 'blog' as the cache path so that if we change
-	// templates, all the cached HTML gets invalidated.
-	var data []byte
+	// Use the directory holding both templates and posts ('blog' by default)
+	// as the cache path so that if we change templates, all the cached HTML gets invalidated.
+	var page cachedPage
 	pp := "bloghtml:" + p
 	if draft && !isOwner {
 		pp += ",user=" + user
 	}
-	if key, ok := ctxt.CacheLoad(pp, "blog", &data); !ok {
-		meta, article, err := loadPost(ctxt, p, req)
-		if err != nil || meta.IsDraft() != draft || (draft && !isOwner && !meta.canRead(user)) {
+	if key, ok := cacheLoad(req, ctxt, pp, &page); !ok {
+		// Concurrent misses of the same page share a single render.
+		// Large posts are rendered by each request on its own instead, streaming
+		// to its client, so that no request waits on another client's connection.
+		var (
+			v        interface{}
+			err      error
+			streamed bool
+		)
+		if largePost(ctxt, p) {
+			v, streamed, err = renderPost(ctx, req, p, draft, isOwner, user, pc, w)
+		} else {
+			v, err, _ = renderGroup.Do(pp, func() (interface{}, error) {
+				page, _, err := renderPost(ctx, req, p, draft, isOwner, user, pc, nil)
+				return page, err
+			})
+		}
+		if _, ok := err.(*loadTimeoutError); ok {
+			ctxt.Criticalf("request=%s %v", reqID, err)
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "post temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if herr, ok := err.(*headerError); ok {
+			ctxt.Criticalf("request=%s %v", reqID, herr)
+			if ae.IsDevAppServer() {
+				http.Error(w, fmt.Sprintf("%v\n\n%s", herr, herr.Snippet), http.StatusInternalServerError)
+			} else {
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+		if err != nil {
 			ctxt.Criticalf("no %s for %s", p, user)
-			notfound(ctxt, w, req)
+			notfound(ctxt, w, req, reqID)
 			return
 		}
-		t := mainTemplate(ctxt)
-		template.Must(t.New("article").Parse(article))
+		page = *v.(*cachedPage)
+		cacheStore(req, ctxt, key, pp, &page)
+		if streamed {
+			return
+		}
+	}
+	page.write(w)
+}
 
-		var buf bytes.Buffer
-		meta.Comments = true
-		if err := t.Execute(&buf, meta); err != nil {
-			panic(err)
+// renderGroup deduplicates the renders of pages missing from the cache.
+var renderGroup singleflight.Group
+
+// largePost reports whether the post p is streamed, judging by the file size
+// recorded in the blogcache. Posts not in the blogcache yet are not.
+func largePost(c *fs.Context, p string) bool {
+	if config.StreamThresholdBytes <= 0 {
+		return false
+	}
+	for name, meta := range readPostCache(c) {
+		if postURLName(name) == p {
+			return meta.FileSize >= int64(config.StreamThresholdBytes)
 		}
-		data = buf.Bytes()
-		ctxt.CacheStore(key, data)
 	}
-	w.Write(data)
+	return false
+}
+
+// errNoPost is returned by renderPost for posts that do not exist or that user may not read.
+var errNoPost = errors.New("no such post")
+
+// renderPost renders the page of the post p for serve.
+// If w is not nil, posts of at least Config.StreamThresholdBytes are also written
+// to w as they render, in which case streamed is set.
+func renderPost(ctx context.Context, req *http.Request, p string, draft, isOwner bool, user string, pc *panicContext, w http.ResponseWriter) (page *cachedPage, streamed bool, err error) {
+	ctxt := mustFsContext(ctx)
+	pc.stage = "load"
+	meta, article, err := loadPost(ctx, p, req)
+	switch err.(type) {
+	case *loadTimeoutError, *headerError:
+		return nil, false, err
+	}
+	if err != nil || meta.IsDraft() != draft || (draft && !isOwner && !meta.canRead(user)) {
+		return nil, false, errNoPost
+	}
+	pc.stage = "render"
+	if !draft {
+		meta.DraftNote = "" // Not for readers
+	}
+	t := mainTemplate(ctxt)
+	template.Must(t.New("article").Parse(article))
+
+	var buf bytes.Buffer
+	meta.Comments = true
+	meta.CustomCSS = staticURL(meta.HostURL, meta.CustomCSS)
+	meta.Analytics = analyticsSnippet()
+	meta.SocialLinks = config.SocialLinks
+	meta.Reactions = loadReactions(ctxt, meta.Name)
+	postCache := readPostCache(ctxt)
+	meta.RelatedPosts = relatedPosts(meta, postCache)
+	meta.Prev, meta.Next = neighbors(meta, postCache)
+	if config.AMPEnabled && !draft {
+		meta.AMPURL = config.BasePathPrefix + "/amp" + meta.Name
+	}
+	page = &cachedPage{Header: http.Header{}}
+	page.Header.Set("Last-Modified", meta.ModTime().UTC().Format(http.TimeFormat))
+	if meta.Language != "" {
+		page.Header.Set("Content-Language", meta.Language)
+	}
+	if meta.Deprecation != "" {
+		page.Header.Set("X-Blog-Deprecated", "true")
+	}
+	if meta.Sponsored() {
+		page.Header.Set("X-Blog-Sponsored", "true")
+	}
+	if meta.Noindex {
+		page.Header.Set("X-Robots-Tag", "noindex")
+	}
+
+	var out io.Writer = &buf
+	if w != nil && config.StreamThresholdBytes > 0 && meta.FileSize >= int64(config.StreamThresholdBytes) {
+		for k, v := range page.Header {
+			w.Header()[k] = v
+		}
+		out, streamed = io.MultiWriter(w, &buf), true
+	}
+	if err := t.Execute(out, meta); err != nil {
+		panic(err)
+	}
+	page.HTML = buf.Bytes()
+	return page, streamed, nil
+}
+
+// panicContext describes what serve was doing, for the log of a recovered panic.
+type panicContext struct {
+	stage string // "route", "feed", "toc", "static", "load" or "render"
+	post  string
+	user  string
+	draft bool
+}
+
+func (pc *panicContext) String() string {
+	return fmt.Sprintf("stage=%s post=%s user=%s draft=%v", pc.stage, pc.post, pc.user, pc.draft)
+}
+
+// countingResponseWriter records the status code and body size of a response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
 }
 
-func notfound(ctxt *fs.Context, w http.ResponseWriter, req *http.Request) {
+func (w *countingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += n
+	return n, err
+}
+
+// cachedPage is a rendered post page, as stored in memcache.
+// Header holds the response headers that depend on the post metadata,
+// so that they can be replayed on cache hits.
+type cachedPage struct {
+	Header http.Header
+	HTML   []byte
+}
+
+func (page *cachedPage) write(w http.ResponseWriter) {
+	for k, v := range page.Header {
+		w.Header()[k] = v
+	}
+	w.Write(page.HTML)
+}
+
+// staticURL resolves the name of a file in blog/static/ to its URL.
+// Absolute paths and URLs are returned unchanged.
+func staticURL(host, name string) string {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "://") {
+		return name
+	}
+	return host + "/" + name
+}
+
+// staticETag returns the ETag of a static file, derived from a hash of its content.
+// ETags are cached alongside the file and recomputed when it changes.
+// It returns the empty string if the file cannot be read.
+func staticETag(c *fs.Context, name string) string {
+	var etag string
+	if key, ok := c.CacheLoad("blog:etag:"+name, name, &etag); !ok {
+		data, _, err := c.Read(name)
+		if err != nil {
+			return ""
+		}
+		etag = fmt.Sprintf(`"%x"`, sha1.Sum(data))
+		c.CacheStore(key, etag)
+	}
+	return etag
+}
+
+// newRequestID returns a random identifier for correlating the log lines of a request.
+func newRequestID() string {
+	return fmt.Sprintf("%x", rand.Int63())
+}
+
+func notfound(ctxt *fs.Context, w http.ResponseWriter, req *http.Request, reqID string) {
+	ctxt.Criticalf("NOT FOUND %s request=%s", req.URL.Path, reqID)
 	var buf bytes.Buffer
 	var data struct {
-		HostURL string
+		HostURL     string
+		SocialLinks []SocialLink
 	}
 	data.HostURL = hostURL(req)
+	data.SocialLinks = config.SocialLinks
 	t := mainTemplate(ctxt)
 	if err := t.Lookup("404").Execute(&buf, &data); err != nil {
 		panic(err)
@@ -275,59 +911,280 @@ func notfound(ctxt *fs.Context, w http.ResponseWriter, req *http.Request) {
 	w.Write(buf.Bytes())
 }
 
+// defaultTemplates are used in place of blog/main.html and blog/style.html
+// when Config.EmbedDefaultTemplates is set and the appfs has none.
+//
+//go:embed defaults/*.html
+var defaultTemplates embed.FS
+
+// templateCache maps template names to the *cachedTemplate parsed from them.
+var templateCache sync.Map
+
+// cachedTemplate is a parsed template with the hash of its source.
+// The template itself is never executed; users get clones.
+type cachedTemplate struct {
+	t      *template.Template
+	hash   [sha1.Size]byte
+	loaded time.Time // When the source was last read
+}
+
+// mainTemplate returns the post, toc and 404 templates.
+// The sources are re-read on every call, or once per Config.TemplateReloadInterval if set,
+// and re-parsed only if they have changed.
 func mainTemplate(c *fs.Context) *template.Template {
-	t := template.New("main")
-	t.Funcs(funcMap)
+	interval := config.TemplateReloadInterval
+	v, ok := templateCache.Load("main")
+	if ok && interval > 0 && time.Since(v.(*cachedTemplate).loaded) < interval {
+		return template.Must(v.(*cachedTemplate).t.Clone())
+	}
+	src := readMainTemplate(c)
+	ct := &cachedTemplate{hash: sha1.Sum(src), loaded: time.Now()}
+	if ok && v.(*cachedTemplate).hash == ct.hash {
+		ct.t = v.(*cachedTemplate).t
+	} else {
+		ct.t = parseMainTemplate(src)
+	}
+	templateCache.Store("main", ct)
+	return template.Must(ct.t.Clone())
+}
 
-	main, _, err := c.Read("blog/main.html")
-	if err != nil {
+// readMainTemplate returns the concatenated sources of main.html and style.html.
+func readMainTemplate(c *fs.Context) []byte {
+	main, _, err := c.Read(templatePath("main.html"))
+	var style []byte
+	switch {
+	case err == nil:
+		style, _, _ = c.Read(templatePath("style.html"))
+	case config.EmbedDefaultTemplates:
+		c.Criticalf("read main.html: %v; using default templates", err)
+		main, _ = defaultTemplates.ReadFile("defaults/main.html")
+		style, _ = defaultTemplates.ReadFile("defaults/style.html")
+	default:
 		panic(err)
 	}
-	style, _, _ := c.Read("blog/style.html")
-	main = append(main, style...)
-	_, err = t.Parse(string(main))
-	if err != nil {
+	return append(main, style...)
+}
+
+func parseMainTemplate(src []byte) *template.Template {
+	t := template.New("main")
+	t.Funcs(funcMap)
+	if _, err := t.Parse(string(src)); err != nil {
 		panic(err)
 	}
 	return t
 }
 
 // ☻ Parse a post file
-func loadPost(c *fs.Context, name string, req *http.Request) (meta *PostData, article string, err error) {
+// The name may be given with or without Config.PostFileExtension.
+func loadPost(ctx context.Context, name string, req *http.Request) (meta *PostData, article string, err error) {
+	c := mustFsContext(ctx)
+	name = postName(name)
 	meta = &PostData{
 		Name:       name,
 		Title:      "¿Title?",
+		Language:   config.DefaultLanguage,
+		Schema:     defaultSchema,
 		PlusAuthor: config.PlusID,
 		PlusAPIKey: config.PlusKey,
 		HostURL:    hostURL(req),
+
+		TwitterAuthor: config.TwitterHandle,
+		CommentSystem: config.CommentSystem,
+		License:       config.DefaultLicense,
 	}
 
-	art, fi, err := c.Read(name)
+	art, fi, err := readTimeout(ctx, name+config.PostFileExtension)
 	if err != nil {
 		return nil, "", err
 	}
 	if bytes.HasPrefix(art, []byte("{\n")) {
 		i := bytes.Index(art, []byte("\n}\n"))
 		if i < 0 {
-			panic("cannot find end of json metadata")
+			return nil, "", &headerError{Name: name, Err: errors.New("cannot find end of json metadata")}
 		}
 		hdr, rest := art[:i+3], art[i+3:]
 		if err := json.Unmarshal(hdr, meta); err != nil {
-			panic(fmt.Sprintf("loading %s: %s", name, err))
+			return nil, "", newHeaderError(name, hdr, err)
 		}
 		art = rest
 	}
 	meta.FileModTime = fi.ModTime
 	meta.FileSize = fi.Size
+	meta.TwitterAuthor = strings.TrimPrefix(meta.TwitterAuthor, "@")
+	if len(meta.Keywords) == 0 {
+		meta.Keywords = meta.Tags
+	}
+	if meta.GHIssueURL != "" {
+		// A linked issue takes precedence over the Google+ and Disqus widgets.
+		meta.CommentSystem = "github-issues"
+	}
+	if !allowedSchema(meta.Schema) {
+		c.Criticalf("loading %s: schema %q not allowed, using %s", name, meta.Schema, defaultSchema)
+		meta.Schema = defaultSchema
+	}
+
+	meta.Abstract = template.HTML(replaceText(string(meta.Abstract)))
+	article = replaceText(string(art))
+	article = embedDemo(meta, article)
+	meta.Footnotes, article = footnotes(article)
+	if config.SyntaxHighlight {
+		article = highlight(article)
+	}
+	meta.TableOfContents, article = headingTOC(article)
+	article, missing := imageAlt(article, meta.ImageAlt)
+	if len(missing) > 0 && ae.IsDevAppServer() {
+		c.Criticalf("loading %s: no alt text for images %v", name, missing)
+	}
+	countStats(meta, article)
+	return meta, article, nil
+}
+
+// headerError reports a malformed JSON header of a post file.
+type headerError struct {
+	Name    string
+	Line    int    // Line of the error within the header, if known
+	Snippet string // Header text around the error
+	Err     error
+}
+
+func (e *headerError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("loading %s: %v", e.Name, e.Err)
+	}
+	return fmt.Sprintf("loading %s: line %d: %v", e.Name, e.Line, e.Err)
+}
+
+// newHeaderError locates the JSON decoding error err within hdr, the header of the post name.
+func newHeaderError(name string, hdr []byte, err error) *headerError {
+	e := &headerError{Name: name, Err: err}
+	var off int64
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		off = err.Offset
+	case *json.UnmarshalTypeError:
+		off = err.Offset
+	default:
+		return e
+	}
+	if off > int64(len(hdr)) {
+		off = int64(len(hdr))
+	}
+	e.Line = 1 + bytes.Count(hdr[:off], []byte("\n"))
+	lo, hi := off-40, off+40
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > int64(len(hdr)) {
+		hi = int64(len(hdr))
+	}
+	e.Snippet = string(hdr[lo:hi])
+	return e
+}
+
+// loadTimeoutError reports a post read that exceeded Config.PostLoadTimeout.
+type loadTimeoutError struct {
+	name    string
+	timeout time.Duration
+}
+
+func (e *loadTimeoutError) Error() string {
+	return fmt.Sprintf("loadPost %s: timeout after %v", e.name, e.timeout)
+}
+
+// readTimeout reads the appfs file name, giving up after Config.PostLoadTimeout (5s if zero).
+func readTimeout(ctx context.Context, name string) ([]byte, *proto.FileInfo, error) {
+	timeout := config.PostLoadTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		data []byte
+		fi   *proto.FileInfo
+		err  error
+	}
+	ch := make(chan result, 1) // Buffered so that an abandoned read does not leak its goroutine
+	go func() {
+		data, fi, err := mustFsContext(ctx).Read(name)
+		ch <- result{data, fi, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.data, r.fi, r.err
+	case <-ctx.Done():
+		return nil, nil, &loadTimeoutError{postName(name), timeout}
+	}
+}
 
-	return meta, replacer.Replace(string(art)), nil
+// defaultSchema is the schema.org type of posts that do not specify one.
+const defaultSchema = "BlogPosting"
+
+// defaultSchemas are the schema.org types allowed when Config.AllowedSchemas is empty.
+var defaultSchemas = []string{"BlogPosting", "Article", "TechArticle", "NewsArticle", "HowTo", "Review"}
+
+func allowedSchema(schema string) bool {
+	allowed := config.AllowedSchemas
+	if len(allowed) == 0 {
+		allowed = defaultSchemas
+	}
+	for _, s := range allowed {
+		if s == schema {
+			return true
+		}
+	}
+	return false
 }
 
 type byTime []*PostData
 
-func (x byTime) Len() int           { return len(x) }
-func (x byTime) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
-func (x byTime) Less(i, j int) bool { return x[i].Date.Time.After(x[j].Date.Time) }
+func (x byTime) Len() int      { return len(x) }
+func (x byTime) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+func (x byTime) Less(i, j int) bool {
+	if !x[i].Date.Equal(x[j].Date.Time) {
+		return x[i].Date.After(x[j].Date.Time)
+	}
+	return x[i].Title < x[j].Title // Break ties deterministically
+}
+
+// byUpdated orders posts by their last revision, most recent first.
+type byUpdated []*PostData
+
+func (x byUpdated) Len() int           { return len(x) }
+func (x byUpdated) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x byUpdated) Less(i, j int) bool { return x[i].Updated().After(x[j].Updated()) }
+
+// undatedLast moves the posts with HideDate set to the end of posts, keeping the order otherwise.
+func undatedLast(posts []*PostData) []*PostData {
+	var dated, undated []*PostData
+	for _, meta := range posts {
+		if meta.HideDate {
+			undated = append(undated, meta)
+		} else {
+			dated = append(dated, meta)
+		}
+	}
+	return append(dated, undated...)
+}
+
+type byEstimatedPublishDate []*PostData
+
+func (x byEstimatedPublishDate) Len() int      { return len(x) }
+func (x byEstimatedPublishDate) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+func (x byEstimatedPublishDate) Less(i, j int) bool {
+	return x[i].EstimatedPublishDate.After(x[j].EstimatedPublishDate.Time)
+}
+
+// byFavorites orders favorites before other posts, each group chronologically.
+type byFavorites struct{ byTime }
+
+func (x byFavorites) Less(i, j int) bool {
+	if x.byTime[i].Favorite != x.byTime[j].Favorite {
+		return x.byTime[i].Favorite
+	}
+	return x.byTime.Less(i, j)
+}
 
 type TocData struct {
 	User      string
@@ -335,12 +1192,58 @@ type TocData struct {
 	HostURL   string
 	DraftRoot string // Base URL+path of draft articles
 	PostRoot  string // Base URL+path of published articles
+	Language  string // Language of the page; the lang filter if given
 	Posts     []*PostData
+	Upcoming  []*PostData   // Drafts with an estimated publish date, soonest first
+	Analytics template.HTML // Analytics snippet for the page head
+	TocStats
+
+	FavoriteCount int // Number of favorites in Posts
+
+	SidebarPosts []*PostData  // Posts with ShowInSidebar set, most recent first
+	Levels       []string     // Distinct reading levels of the posts, for level filters
+	SocialLinks  []SocialLink // Config.SocialLinks
+
+	ByType map[string][]*PostData // Posts grouped by ArticleType, in the order of Posts
+}
+
+// TocStats are aggregate statistics of the posts listed on a TOC page.
+type TocStats struct {
+	TotalPosts      int
+	TotalWords      int
+	TotalFavorites  int
+	DeprecatedCount int
+	OldestPost      *PostData
+	NewestPost      *PostData
+}
+
+func tocStats(posts []*PostData) TocStats {
+	var s TocStats
+	for _, meta := range posts {
+		s.TotalPosts++
+		s.TotalWords += meta.WordCount
+		if meta.Favorite {
+			s.TotalFavorites++
+		}
+		if meta.Deprecation != "" {
+			s.DeprecatedCount++
+		}
+		if meta.Date.IsZero() {
+			continue
+		}
+		if s.OldestPost == nil || meta.Date.Before(s.OldestPost.Date.Time) {
+			s.OldestPost = meta
+		}
+		if s.NewestPost == nil || meta.Date.After(s.NewestPost.Date.Time) {
+			s.NewestPost = meta
+		}
+	}
+	return s
 }
 
 // toc traverses the file system to build the list of posts
-func toc(w http.ResponseWriter, req *http.Request, draft bool, isOwner bool, user string) {
-	c := fs.NewContext(req)
+func toc(ctx context.Context, w http.ResponseWriter, req *http.Request, draft bool, isOwner bool, user string) {
+	c := mustFsContext(ctx)
 	c.Criticalf("toc() draft=%v isOwner=%v user=%s", draft, isOwner, user)
 
 	// ☻ Compute cache key for this page
@@ -349,15 +1252,21 @@ func toc(w http.ResponseWriter, req *http.Request, draft bool, isOwner bool, use
 	if req.FormValue("readdir") != "" {
 		keystr += ",readdir=" + req.FormValue("readdir") // If "readdir:" form value is given, add to cache key
 	}
+	if req.FormValue("lang") != "" {
+		keystr += ",lang=" + req.FormValue("lang") // If "lang" form value is given, add to cache key
+	}
+	if req.FormValue("level") != "" {
+		keystr += ",level=" + req.FormValue("level") // If "level" form value is given, add to cache key
+	}
 	if draft {
 		keystr += ",user=" + user // If in draft mode, add user to cache key
 	}
 
 	// ☻ Try to load the page from the cache,
-	if key, ok := c.CacheLoad(keystr, "blog", &data); ok {
+	if key, ok := cacheLoad(req, c, keystr, &data); ok {
 		w.Write(data)
 	} else {
-		gentoc(w, req, key, draft, isOwner, user)
+		gentoc(ctx, w, req, key, keystr, draft, isOwner, user)
 	}
 }
 
@@ -365,20 +1274,128 @@ func readDir(c *fs.Context, root string) ([]proto.FileInfo, error) {
 	return c.ReadDir(root)
 }
 
-// readDirEllipses returns the file infos of all files descendent to root, and
+// defaultPostDirMaxDepth is the directory depth limit used when a configured limit is zero.
+const defaultPostDirMaxDepth = 5
+
+// depthLimit returns the directory depth limit configured as n:
+// defaultPostDirMaxDepth if n is zero, and no recursion if n is negative.
+func depthLimit(n int) int {
+	switch {
+	case n == 0:
+		return defaultPostDirMaxDepth
+	case n < 0:
+		return 0
+	}
+	return n
+}
+
+// postDirMaxDepth returns the depth limit of the posts directory tree.
+func postDirMaxDepth() int {
+	return depthLimit(config.PostDirMaxDepth)
+}
+
+// ReadDirEllipsesOpts controls the traversal of ReadDirEllipses.
+type ReadDirEllipsesOpts struct {
+	MaxDepth int // Subdirectories nested deeper than MaxDepth below root are skipped; 5 if zero, none if negative
+}
+
+// ReadDirEllipses returns the file infos of all files descendent to root,
+// down to opts.MaxDepth levels of subdirectories.
 // FileInfo.Name indicates the full file paths relative to root.
-func readDirEllipses(c *fs.Context, root string) (r []proto.FileInfo, err error) {
+func ReadDirEllipses(c *fs.Context, root string, opts ReadDirEllipsesOpts) ([]proto.FileInfo, error) {
+	return readDirEllipses(c, root, depthLimit(opts.MaxDepth))
+}
+
+func postsDir() string {
+	if config.PostsDirectory != "" {
+		return config.PostsDirectory
+	}
+	return "blog/post"
+}
+
+func templatePath(name string) string {
+	dir := config.TemplateDirectory
+	if dir == "" {
+		dir = "blog"
+	}
+	return path.Join(dir, name)
+}
+
+// cacheRoot returns the deepest directory containing both the templates and the posts.
+// Pages cached under it are invalidated when either changes.
+// If the two share no directory, it is the posts directory: the file system root
+// would also hold the blogcache and reactions/, whose writes must not flush pages.
+func cacheRoot() string {
+	if root := commonDir(path.Dir(templatePath("main.html")), postsDir()); root != "" {
+		return root
+	}
+	return postsDir()
+}
+
+// commonDir returns the deepest directory containing both a and b, or "" if there is none.
+func commonDir(a, b string) string {
+	t := strings.Split(strings.Trim(path.Clean(a), "/"), "/")
+	p := strings.Split(strings.Trim(path.Clean(b), "/"), "/")
+	i := 0
+	for i < len(t) && i < len(p) && t[i] == p[i] {
+		i++
+	}
+	return strings.Join(t[:i], "/")
+}
+
+// readPostDir returns the file infos of all posts.
+func readPostDir(c *fs.Context) ([]proto.FileInfo, error) {
+	dir, err := readDirEllipses(c, postsDir(), postDirMaxDepth())
+	if err != nil {
+		return nil, err
+	}
+	return filterPostFiles(dir), nil
+}
+
+// filterPostFiles returns the entries of dir with the extension Config.PostFileExtension, if set.
+func filterPostFiles(dir []proto.FileInfo) []proto.FileInfo {
+	if config.PostFileExtension == "" {
+		return dir
+	}
+	var r []proto.FileInfo
+	for _, d := range dir {
+		if strings.HasSuffix(d.Name, config.PostFileExtension) {
+			r = append(r, d)
+		}
+	}
+	return r
+}
+
+// postName returns the name of the post stored in file, which is the file name
+// without Config.PostFileExtension.
+func postName(file string) string {
+	return strings.TrimSuffix(file, config.PostFileExtension)
+}
+
+// readDirEllipses returns the file infos of all files descendent to root, sorted by name, and
+// FileInfo.Name indicates the full file paths relative to root.
+// Directories nested deeper than maxDepth below root are skipped.
+func readDirEllipses(c *fs.Context, root string, maxDepth int) (r []proto.FileInfo, err error) {
+	type qdir struct {
+		path  string
+		depth int
+	}
 	var q list.List // Queue of root-relative directory paths to recurse into
-	q.PushBack(root)
+	q.PushBack(qdir{root, 0})
 	for e := q.Front(); e != nil; e = q.Front() {
-		rpath := q.Remove(e).(string)
+		qd := q.Remove(e).(qdir)
+		rpath := qd.path
 		if children, err := readDir(c, rpath); err != nil {
 			return nil, err
 		} else {
 			for _, dir := range children {
 				full := path.Join(rpath, dir.Name)
 				if dir.IsDir {
-					q.PushBack(full)
+					if qd.depth+1 > maxDepth {
+						c.Criticalf("readDirEllipses: skipping %s, deeper than %d", full, maxDepth)
+						continue
+					}
+					q.PushBack(qdir{full, qd.depth + 1})
 					continue
 				}
 				dir.Name = full // Substitute the name with complete path from root
@@ -386,16 +1403,23 @@ func readDirEllipses(c *fs.Context, root string) (r []proto.FileInfo, err error)
 			}
 		}
 	}
+	sort.Sort(byName(r)) // Make the result independent of the directory listing order
 	return
 }
 
+type byName []proto.FileInfo
+
+func (x byName) Len() int           { return len(x) }
+func (x byName) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x byName) Less(i, j int) bool { return x[i].Name < x[j].Name }
+
 // ☻ Rebuild the TOC page, used on cache misses in toc.
-func gentoc(w http.ResponseWriter, req *http.Request, key fs.CacheKey, draft, isOwner bool, user string) {
+func gentoc(ctx context.Context, w http.ResponseWriter, req *http.Request, key fs.CacheKey, keystr string, draft, isOwner bool, user string) {
 	var data []byte
-	c := fs.NewContext(req)
+	c := mustFsContext(ctx)
 
 	// ☻ Traverse "/blog/post/..." and its descendants
-	dir, err := readDirEllipses(c, "blog/post")
+	dir, err := readPostDir(c)
 	if err != nil {
 		panic(err)
 	}
@@ -406,13 +1430,118 @@ func gentoc(w http.ResponseWriter, req *http.Request, key fs.CacheKey, draft, is
 		return
 	}
 
-	// ☻ Read postName–>postData from file "/blogcache", if any available
-	postCache := map[string]*PostData{}
-	if data, _, err := c.Read("blogcache"); err == nil {
-		if err := json.Unmarshal(data, &postCache); err != nil {
-			c.Criticalf("unmarshal blogcache: %v", err)
+	posts := loadAllPosts(ctx, req, dir)
+	checkSeriesLinks(c, posts)
+	all := visiblePosts(posts, draft, isOwner, user)
+	upcoming := upcomingPosts(posts)
+
+	lang := config.DefaultLanguage
+	if l := req.FormValue("lang"); l != "" { // ☻ Filter posts by language
+		lang = l
+		all = filterLanguage(all, lang)
+	}
+	if !draft {
+		all, upcoming = withoutDraftNotes(all), withoutDraftNotes(upcoming)
+	}
+	levels := readingLevels(all)
+	if l := req.FormValue("level"); l != "" { // ☻ Filter posts by reading level
+		all = filterLevel(all, l)
+	}
+	switch config.TOCSort {
+	case "favorites-first":
+		sort.Sort(byFavorites{all})
+	case "updated":
+		sort.Sort(byUpdated(all))
+	}
+	all = undatedLast(all)
+	stats := tocStats(all)
+	if !draft && lang == config.DefaultLanguage && req.FormValue("level") == "" {
+		storeStats(req, &stats)
+	}
+
+	var buf bytes.Buffer // ☻ Render TOC page
+	t := mainTemplate(c)
+	if err := t.Lookup("toc").Execute(&buf, &TocData{
+		User:      c.User(),
+		Draft:     draft,
+		HostURL:   hostURL(req),
+		DraftRoot: config.BasePathPrefix + "/draft",
+		PostRoot:  config.BasePathPrefix + "/",
+		Language:  lang,
+		Posts:     all,
+		Upcoming:  upcoming,
+		Analytics: analyticsSnippet(),
+		TocStats:  stats,
+
+		FavoriteCount: stats.TotalFavorites,
+		SidebarPosts:  sidebarPosts(all),
+		Levels:        levels,
+		SocialLinks:   config.SocialLinks,
+		ByType:        groupByType(all),
+	}); err != nil {
+		panic(err)
+	}
+	data = buf.Bytes()
+	cacheStore(req, c, key, keystr, data)
+	//
+	w.Write(data)
+}
+
+// loadPosts loads the metadata of the posts in dir, consulting and refreshing "/blogcache",
+// and returns the posts visible to user, sorted chronologically.
+func loadPosts(ctx context.Context, req *http.Request, dir []proto.FileInfo, draft, isOwner bool, user string) []*PostData {
+	return visiblePosts(loadAllPosts(ctx, req, dir), draft, isOwner, user)
+}
+
+// visiblePosts returns the posts listed in the TOC for user.
+func visiblePosts(posts []*PostData, draft, isOwner bool, user string) []*PostData {
+	var all []*PostData
+	for _, meta := range posts {
+		if (!draft && !meta.IsDraft() && !meta.NotInTOC) || (isOwner && draft) || meta.canRead(user) {
+			all = append(all, meta)
+		}
+	}
+	return all
+}
+
+// sidebarPosts returns the most recent posts with ShowInSidebar set,
+// up to Config.SidebarPostCount of them.
+func sidebarPosts(posts []*PostData) []*PostData {
+	n := config.SidebarPostCount
+	if n == 0 {
+		n = 5
+	}
+	var r []*PostData
+	for _, meta := range posts {
+		if meta.ShowInSidebar {
+			r = append(r, meta)
+		}
+	}
+	sort.Sort(byTime(r))
+	if len(r) > n {
+		r = r[:n]
+	}
+	return r
+}
+
+// upcomingPosts returns the drafts with an estimated publish date, soonest first.
+func upcomingPosts(posts []*PostData) []*PostData {
+	var r []*PostData
+	for _, meta := range posts {
+		if meta.IsDraft() && !meta.EstimatedPublishDate.IsZero() {
+			r = append(r, meta)
 		}
 	}
+	sort.Sort(sort.Reverse(byEstimatedPublishDate(r)))
+	return r
+}
+
+// loadAllPosts loads the metadata of the posts in dir, consulting and refreshing "/blogcache",
+// and returns all of them, sorted chronologically.
+func loadAllPosts(ctx context.Context, req *http.Request, dir []proto.FileInfo) []*PostData {
+	c := mustFsContext(ctx)
+	// ☻ Read postName–>postData from file "/blogcache", if any available
+	postCache := readPostCache(c)
 
 	ch := make(chan *PostData, len(dir)) // ☻ Create a channel whose buffer size equals the number of files in "blog/post"
 	// XXX: This is a limiting mechanism. Use limiter.
@@ -422,8 +1551,9 @@ func gentoc(w http.ResponseWriter, req *http.Request, key fs.CacheKey, draft, is
 		limit <- true
 	}
 	//
+	reloaded := 0
 	for _, d := range dir { // For each file in directory,
-		if meta := postCache[d.Name]; meta != nil && // Attempt to fetch post meta from "blogcache" file cache; if present, and
+		if meta := postCache[postName(d.Name)]; meta != nil && // Attempt to fetch post meta from "blogcache" file cache; if present, and
 			meta.FileModTime.Equal(d.ModTime) && // The cache copy is not older than the original, and
 			meta.FileSize == d.Size { // They match in size
 			//
@@ -431,10 +1561,11 @@ func gentoc(w http.ResponseWriter, req *http.Request, key fs.CacheKey, draft, is
 			continue
 		}
 
+		reloaded++
 		<-limit
 		go func(d proto.FileInfo) { // Fetch post in parallel
 			defer func() { limit <- true }()
-			meta, _, err := loadPost(c, d.Name, req)
+			meta, _, err := loadPost(ctx, d.Name, req)
 			if err != nil {
 				// Should not happen: we just listed the directory.
 				c.Criticalf("loadPost %s: %v", d.Name, err)
@@ -448,14 +1579,19 @@ func gentoc(w http.ResponseWriter, req *http.Request, key fs.CacheKey, draft, is
 	}
 	close(ch) // Write eof
 
-	postCache = map[string]*PostData{} // ☻ Update postCache with the fresh data and apply permission/draft filters
+	cached := len(postCache)
+	postCache = map[string]*PostData{} // ☻ Update postCache with the fresh data, dropping deleted posts
 	var all []*PostData
 	for meta := range ch {
 		postCache[meta.Name] = meta
-		if (!draft && !meta.IsDraft() && !meta.NotInTOC) || (isOwner && draft) || meta.canRead(user) {
-			all = append(all, meta)
-		}
+		all = append(all, meta)
+	}
+	// ☻ Every entry is a cached one and none was deleted: "/blogcache" is up to date
+	if reloaded == 0 && len(postCache) == cached {
+		sort.Sort(byTime(all))
+		return all
 	}
+	c.Criticalf("blogcache: reloaded %d of %d posts", reloaded, len(dir))
 	sort.Sort(byTime(all)) // ☻ Sort posts chronologically
 
 	if data, err := json.Marshal(postCache); err != nil { // ☻ Write new TOC cache to "/blogcache"
@@ -463,58 +1599,189 @@ func gentoc(w http.ResponseWriter, req *http.Request, key fs.CacheKey, draft, is
 	} else if err := c.Write("blogcache", data); err != nil {
 		c.Criticalf("write blogcache: %v", err)
 	}
+	return all
+}
 
-	var buf bytes.Buffer // ☻ Render TOC page
-	t := mainTemplate(c)
-	if err := t.Lookup("toc").Execute(&buf, &TocData{
-		User:      c.User(),
-		Draft:     draft,
-		HostURL:   hostURL(req),
-		DraftRoot: "/draft",
-		PostRoot:  "/",
-		Posts:     all,
-	}); err != nil {
-		panic(err)
+// filterLanguage returns the posts written in language lang.
+func filterLanguage(posts []*PostData, lang string) []*PostData {
+	var r []*PostData
+	for _, meta := range posts {
+		if meta.Language == lang {
+			r = append(r, meta)
+		}
 	}
-	data = buf.Bytes()
-	c.CacheStore(key, data)
-	//
-	w.Write(data)
+	return r
 }
 
-func hostURL(req *http.Request) string {
-	if strings.Index(req.Host, "localhost") >= 0 {
-		return "http://localhost:8000"
+// withoutDraftNotes returns posts with copies in place of the posts having a DraftNote,
+// with the note removed, for pages shown to readers.
+func withoutDraftNotes(posts []*PostData) []*PostData {
+	r := make([]*PostData, len(posts))
+	for i, meta := range posts {
+		if meta.DraftNote != "" {
+			m := *meta
+			m.DraftNote = ""
+			meta = &m
+		}
+		r[i] = meta
 	}
-	return config.PublicURL
+	return r
 }
 
-func atomfeed(w http.ResponseWriter, req *http.Request) {
-	c := fs.NewContext(req)
+// groupByType groups posts by their ArticleType, keeping their order.
+func groupByType(posts []*PostData) map[string][]*PostData {
+	r := map[string][]*PostData{}
+	for _, meta := range posts {
+		r[meta.ArticleType] = append(r[meta.ArticleType], meta)
+	}
+	return r
+}
 
-	c.Criticalf("Header: %v", req.Header)
+// filterLevel returns the posts of the given reading level.
+func filterLevel(posts []*PostData, level string) []*PostData {
+	var r []*PostData
+	for _, meta := range posts {
+		if meta.ReadingLevel == level {
+			r = append(r, meta)
+		}
+	}
+	return r
+}
 
-	var data []byte
-	if key, ok := c.CacheLoad("blog:atomfeed", "blog/post", &data); !ok {
-		dir, err := c.ReadDir("blog/post")
+// readingLevels returns the distinct reading levels of posts, sorted.
+func readingLevels(posts []*PostData) []string {
+	seen := map[string]bool{}
+	var r []string
+	for _, meta := range posts {
+		if l := meta.ReadingLevel; l != "" && !seen[l] {
+			seen[l] = true
+			r = append(r, l)
+		}
+	}
+	sort.Strings(r)
+	return r
+}
+
+// readPostCache returns the postName–>postData map stored in "/blogcache".
+// It returns an empty map if the file is missing or unreadable.
+func readPostCache(c *fs.Context) map[string]*PostData {
+	postCache := map[string]*PostData{}
+	if data, _, err := c.Read("blogcache"); err == nil {
+		if err := json.Unmarshal(data, &postCache); err != nil {
+			c.Criticalf("unmarshal blogcache: %v", err)
+		}
+	}
+	return postCache
+}
+
+// ownerRequest reports whether req comes from the AppEngine admin or the configured owner account.
+func ownerRequest(c *fs.Context, req *http.Request) bool {
+	return aeu.IsAdmin(ae.NewContext(req)) || c.User() == config.Account
+}
+
+// hostURL returns the absolute URL of the blog root, including the base path prefix.
+// A nil req, as in programmatic access, yields the public URL.
+func hostURL(req *http.Request) string {
+	if req != nil && strings.Index(req.Host, "localhost") >= 0 {
+		return "http://localhost:8000" + config.BasePathPrefix
+	}
+	return config.PublicURL + config.BasePathPrefix
+}
+
+// publishedPosts loads all published posts meant for feeds, including their articles, sorted chronologically.
+func publishedPosts(ctx context.Context, req *http.Request) []*PostData {
+	c := mustFsContext(ctx)
+	dir, err := c.ReadDir(postsDir())
+	if err != nil {
+		panic(err)
+	}
+
+	var all []*PostData
+	for _, d := range filterPostFiles(dir) {
+		meta, article, err := loadPost(ctx, d.Name, req)
 		if err != nil {
+			// Should not happen: we just loaded the directory.
 			panic(err)
 		}
+		if meta.IsDraft() || meta.NotInFeed {
+			continue
+		}
+		meta.article = article
+		meta.DraftNote = "" // Not for readers
+		all = append(all, meta)
+	}
+	sort.Sort(byTime(all))
+	return all
+}
 
-		var all []*PostData
-		for _, d := range dir {
-			meta, article, err := loadPost(c, d.Name, req)
-			if err != nil {
-				// Should not happen: we just loaded the directory.
-				panic(err)
-			}
-			if meta.IsDraft() {
-				continue
+// feedSpec describes a variant of the Atom feed.
+type feedSpec struct {
+	cacheKey   string               // Cache key of the rendered feed
+	path       string               // URL path of the feed
+	selfURL    string               // Self link of the feed; hostURL + path if empty
+	include    func(*PostData) bool // Selects the posts in the feed; nil selects all
+	enclosures bool                 // Attach podcast audio enclosures to entries
+	podcast    bool                 // Add the iTunes podcast extensions
+}
+
+func atomfeed(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	serveFeed(ctx, w, req, &feedSpec{
+		cacheKey:   "blog:atomfeed",
+		path:       "/feed.atom",
+		selfURL:    config.FeedSelfURL,
+		enclosures: config.FeedIncludeEnclosures,
+	})
+}
+
+// podcastfeed serves the Atom feed of the posts carrying podcast audio.
+func podcastfeed(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	serveFeed(ctx, w, req, &feedSpec{
+		cacheKey:   "blog:podcastfeed",
+		path:       "/feed.podcast.atom",
+		include:    func(meta *PostData) bool { return meta.PodcastAudio != "" },
+		enclosures: true,
+		podcast:    true,
+	})
+}
+
+// feedEntryTemplate returns the source of the template rendering the content of feed entries:
+// Config.FeedEntryTemplateHTML if set, otherwise the appfs file Config.FeedEntryTemplate.
+func feedEntryTemplate(c *fs.Context) string {
+	if config.FeedEntryTemplateHTML != "" {
+		return string(config.FeedEntryTemplateHTML)
+	}
+	name := config.FeedEntryTemplate
+	if name == "" {
+		name = templatePath("atom.html")
+	}
+	src, _, err := c.Read(name)
+	if err != nil {
+		panic(err)
+	}
+	return string(src)
+}
+
+func serveFeed(ctx context.Context, w http.ResponseWriter, req *http.Request, spec *feedSpec) {
+	c := mustFsContext(ctx)
+
+	c.Criticalf("Header: %v", req.Header)
+
+	var data []byte
+	if key, ok := cacheLoad(req, c, spec.cacheKey, &data); !ok {
+		all := publishedPosts(ctx, req)
+		self := spec.selfURL
+		if self == "" {
+			self = hostURL(req) + spec.path
+		}
+		if spec.include != nil {
+			var sel []*PostData
+			for _, meta := range all {
+				if spec.include(meta) {
+					sel = append(sel, meta)
+				}
 			}
-			meta.article = article
-			all = append(all, meta)
+			all = sel
 		}
-		sort.Sort(byTime(all))
 
 		show := all
 		if len(show) > 10 {
@@ -538,28 +1805,42 @@ func atomfeed(w http.ResponseWriter, req *http.Request) {
 		//		Rel
 		//		Href
 		feed := &atom.Feed{
-			Title:   config.FeedTitle,
-			ID:      config.FeedID,
-			Updated: atom.Time(show[0].Date.Time),
+			Title: config.FeedTitle,
+			ID:    config.FeedID,
 			Author: &atom.Person{
 				Name:  config.Name,
 				URI:   "https://plus.google.com/" + config.PlusID,
 				Email: config.Email,
 			},
 			Link: []atom.Link{
-				{Rel: "self", Href: hostURL(req) + "/feed.atom"},
+				{Rel: "self", Href: self},
 			},
+			Icon:   config.FeedIconURL,
+			Logo:   config.FeedImageURL,
+			Rights: config.FeedCopyright,
+		}
+		if spec.podcast {
+			feed.ITunesNS = atom.ITunesNamespace
+			feed.ITunesAuthor = config.PodcastAuthor
+			if config.PodcastCategory != "" {
+				feed.ITunesCategory = &atom.ITunesCategory{Text: config.PodcastCategory}
+			}
+			feed.ITunesExplicit = strconv.FormatBool(config.PodcastExplicit)
+		}
+		if config.FeedAuthorURI != "" {
+			feed.Author.URI = config.FeedAuthorURI
+		}
+		if config.FeedAuthorEmail != "" {
+			feed.Author.Email = config.FeedAuthorEmail
+		}
+		if len(show) > 0 { // The podcast feed may well be empty
+			feed.Updated = atom.Time(show[0].Date.Time)
 		}
 
 		for _, meta := range show {
 			t := template.New("main")
 			t.Funcs(funcMap)
-			main, _, err := c.Read("blog/atom.html")
-			if err != nil {
-				panic(err)
-			}
-			_, err = t.Parse(string(main))
-			if err != nil {
+			if _, err := t.Parse(feedEntryTemplate(c)); err != nil {
 				panic(err)
 			}
 			template.Must(t.New("article").Parse(meta.article))
@@ -569,13 +1850,14 @@ func atomfeed(w http.ResponseWriter, req *http.Request) {
 			}
 
 			e := &atom.Entry{
+				Lang:  meta.Language,
 				Title: meta.Title,
 				ID:    feed.ID + "/" + meta.Name,
 				Link: []atom.Link{
 					{Rel: "alternate", Href: meta.HostURL + "/" + meta.Name},
+					{Rel: "canonical", Href: meta.Canonical()},
 				},
-				Published: atom.Time(meta.Date.Time),
-				Updated:   atom.Time(meta.Date.Time),
+				Updated: atom.Time(meta.Updated()),
 				Summary: &atom.Text{
 					Type: "text",
 					Body: meta.Summary,
@@ -585,16 +1867,59 @@ func atomfeed(w http.ResponseWriter, req *http.Request) {
 					Body: buf.String(),
 				},
 			}
+			urls := meta.TranslationURLs()
+			var langs []string
+			for lang := range urls {
+				langs = append(langs, lang)
+			}
+			sort.Strings(langs) // Keep the feed stable
+			for _, lang := range langs {
+				e.Link = append(e.Link, atom.Link{Rel: "alternate", Href: urls[lang], Hreflang: lang})
+			}
+			if g := meta.Gallery(); len(g) > 0 {
+				e.Link = append(e.Link, atom.Link{
+					Rel:  "enclosure",
+					Href: g[0].URL,
+					Type: mime.TypeByExtension(path.Ext(g[0].URL)),
+				})
+			}
+			if meta.ArticleType != "" {
+				e.Category = append(e.Category, atom.Category{Term: meta.ArticleType, Scheme: "blog:post-type"})
+			}
+			if meta.Sponsored() {
+				e.Category = append(e.Category, atom.Category{Term: "sponsored"})
+			}
+			if meta.License != "" {
+				e.Rights = &atom.Text{Type: "text", Body: meta.LicenseName()}
+			}
+			if meta.HideDate {
+				e.Updated = atom.Time(meta.FileModTime)
+			} else {
+				e.Published = atom.Time(meta.Date.Time)
+			}
+			if spec.podcast {
+				e.ITunesEpisode = meta.PodcastEpisodeNumber
+				e.ITunesSeason = meta.PodcastSeason
+			}
+			if spec.enclosures && meta.PodcastAudio != "" {
+				e.Link = append(e.Link, atom.Link{
+					Rel:    "enclosure",
+					Href:   meta.PodcastAudio,
+					Type:   "audio/mpeg",
+					Length: meta.PodcastSize,
+				})
+			}
 
 			feed.Entry = append(feed.Entry, e)
 		}
 
+		var err error
 		data, err = xml.Marshal(&feed)
 		if err != nil {
 			panic(err)
 		}
 
-		c.CacheStore(key, data)
+		cacheStore(req, c, key, spec.cacheKey, data)
 	}
 
 	// Feed readers like to hammer us; let Google cache the
@@ -0,0 +1,248 @@
+package post
+
+import (
+	"bytes"
+	"flag"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+func TestByTimeTies(t *testing.T) {
+	date := blogTime{time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}
+	posts := []*PostData{
+		{Title: "Charlie", Date: date},
+		{Title: "Alpha", Date: date},
+		{Title: "Bravo", Date: date},
+	}
+	sort.Sort(byTime(posts))
+	var titles []string
+	for _, p := range posts {
+		titles = append(titles, p.Title)
+	}
+	want := []string{"Alpha", "Bravo", "Charlie"}
+	for i := range want {
+		if titles[i] != want[i] {
+			t.Fatalf("sorted titles = %q, want %q", titles, want)
+		}
+	}
+}
+
+func FuzzBlogTimeUnmarshalJSON(f *testing.F) {
+	for _, seed := range []string{
+		`"2024-03-01T12:30:00Z"`,
+		`"2024-03-01T12:30:00+02:00"`,
+		`"Friday, March 1, 2024"`,
+		`"March 1, 2024 15:00 -0700"`,
+		`""`,
+		`null`,
+		``,
+		`"`,
+		`"` + strings.Repeat("9", 4096) + `"`,
+		`"\u0046riday, March 1, 2024"`,
+		`"Friday, March 1, 2024`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var bt blogTime
+		err := bt.UnmarshalJSON(data)
+		if err != nil {
+			if !bt.IsZero() {
+				t.Errorf("UnmarshalJSON(%q) = %v, but set the time to %v", data, err, bt.Time)
+			}
+			return
+		}
+		if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+			t.Errorf("UnmarshalJSON(%q) accepted a value that is not a JSON string", data)
+		}
+	})
+}
+
+func TestReactionName(t *testing.T) {
+	config = &Config{}
+	for _, tt := range []struct{ in, want string }{
+		{"foo", "foo"},
+		{"2024/foo", "2024/foo"},
+		{"blog/post/2024/foo", "2024/foo"},
+		{"/blog/post/2024/foo", "2024/foo"},
+		{"../../blogcache", "blogcache"},
+	} {
+		if got := reactionName(tt.in); got != tt.want {
+			t.Errorf("reactionName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// defaultTemplate parses the embedded default templates, with article as the article text.
+func defaultTemplate(t *testing.T, article string) *template.Template {
+	main, err := defaultTemplates.ReadFile("defaults/main.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	style, err := defaultTemplates.ReadFile("defaults/style.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := parseMainTemplate(append(main, style...))
+	template.Must(tmpl.New("article").Parse(article))
+	return tmpl
+}
+
+// checkGolden compares got with testdata/golden/name, or rewrites the file with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	file := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := os.WriteFile(file, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file; run go test -update after checking\ngot:\n%s", name, got)
+	}
+}
+
+func TestGoldenTemplates(t *testing.T) {
+	config = &Config{PublicURL: "https://example.com"}
+	date := blogTime{time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}
+	post := &PostData{
+		Name:      "blog/post/hello",
+		Title:     "Hello, world",
+		Date:      date,
+		Author:    "Ada",
+		Language:  "en",
+		HostURL:   "https://example.com",
+		Footnotes: []Footnote{{ID: "1", Text: "A <em>note</em>."}},
+	}
+	var buf bytes.Buffer
+	if err := defaultTemplate(t, `<p>Text<sup><a id="fnref-1" href="#fn-1">1</a></sup>.</p>`).Execute(&buf, post); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "article.html", buf.Bytes())
+
+	toc := &TocData{
+		HostURL:  "https://example.com",
+		PostRoot: "/",
+		Language: "en",
+		Posts: []*PostData{
+			post,
+			{Name: "blog/post/second", Title: "Second", Date: date, HideDate: true},
+		},
+	}
+	buf.Reset()
+	if err := defaultTemplate(t, "").Lookup("toc").Execute(&buf, toc); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "toc.html", buf.Bytes())
+}
+
+func TestFootnotes(t *testing.T) {
+	for _, tt := range []struct {
+		in, article string
+		notes       []Footnote
+	}{
+		{
+			in:      "<p>A[^1] b.</p>\n[^1]: The <em>note</em>.\n",
+			article: `<p>A<sup><a id="fnref-1" href="#fn-1">1</a></sup> b.</p>` + "\n",
+			notes:   []Footnote{{ID: "1", Text: "The <em>note</em>."}},
+		},
+		{
+			in:      "<p>A[^missing] b.</p>\n",
+			article: "<p>A[^missing] b.</p>\n",
+		},
+		{
+			in:      "<p>A[^x y] b.</p>\n[^x]: Note.\n",
+			article: "<p>A[^x y] b.</p>\n",
+			notes:   []Footnote{{ID: "x", Text: "Note."}},
+		},
+	} {
+		notes, article := footnotes(tt.in)
+		if article != tt.article {
+			t.Errorf("footnotes(%q) article = %q, want %q", tt.in, article, tt.article)
+		}
+		if len(notes) != len(tt.notes) {
+			t.Errorf("footnotes(%q) = %v, want %v", tt.in, notes, tt.notes)
+			continue
+		}
+		for i := range notes {
+			if notes[i] != tt.notes[i] {
+				t.Errorf("footnotes(%q) = %v, want %v", tt.in, notes, tt.notes)
+				break
+			}
+		}
+	}
+}
+
+func TestHeadingTOC(t *testing.T) {
+	in := `<h2>Q&amp;A</h2><h3 id="kept">Kept <em>id</em></h3><h2>Q&amp;A</h2><h2>¿?</h2>`
+	want := []TocEntry{
+		{Level: 2, Text: "Q&A", Anchor: "q-a"},
+		{Level: 3, Text: "Kept id", Anchor: "kept"},
+		{Level: 2, Text: "Q&A", Anchor: "q-a-2"},
+		{Level: 2, Text: "¿?", Anchor: "section"},
+	}
+	wantArticle := `<h2 id="q-a">Q&amp;A</h2><h3 id="kept">Kept <em>id</em></h3><h2 id="q-a-2">Q&amp;A</h2><h2 id="section">¿?</h2>`
+	toc, article := headingTOC(in)
+	if article != wantArticle {
+		t.Errorf("headingTOC article = %q, want %q", article, wantArticle)
+	}
+	if len(toc) != len(want) {
+		t.Fatalf("headingTOC = %v, want %v", toc, want)
+	}
+	for i := range toc {
+		if toc[i] != want[i] {
+			t.Errorf("headingTOC entry %d = %v, want %v", i, toc[i], want[i])
+		}
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"Hello, World", "hello-world"},
+		{"  Go 1.21 ", "go-1-21"},
+		{"Q&A", "q-a"},
+		{"Café", "café"},
+		{"!!!", "section"},
+	} {
+		if got := slugify(tt.in); got != tt.want {
+			t.Errorf("slugify(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptQuality(t *testing.T) {
+	const atom = "application/atom+xml"
+	for _, tt := range []struct {
+		accept string
+		want   float64
+	}{
+		{"", -1},
+		{"text/html", -1},
+		{"*/*", 1},
+		{"application/*;q=0.5", 0.5},
+		{"application/atom+xml;q=0, */*", 0},
+		{"*/*;q=0.1, application/*;q=0.2, application/atom+xml;q=0.3", 0.3},
+		{"application/*;q=0.8, */*;q=1", 0.8},
+	} {
+		if got := acceptQuality(tt.accept, atom); got != tt.want {
+			t.Errorf("acceptQuality(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+	if _, ok := negotiateFeed("application/atom+xml;q=0, */*"); ok {
+		t.Errorf("negotiateFeed accepted Atom refused with q=0")
+	}
+	if _, ok := negotiateFeed("text/html"); !ok {
+		t.Errorf("negotiateFeed refused an Accept header matching no format")
+	}
+}
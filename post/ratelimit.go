@@ -0,0 +1,111 @@
+package post
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// buckets maps client IP addresses to their *tokenBucket.
+var buckets sync.Map
+
+// bucketSweep is how often the bucket maps are swept of idle buckets.
+const bucketSweep = time.Minute
+
+// lastSweep is the time of the last sweep, in Unix nanoseconds.
+var lastSweep int64
+
+// tokenBucket is a per-client token bucket, refilled at Config.RateLimitRPS
+// tokens per second up to Config.RateLimitBurst tokens.
+type tokenBucket struct {
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take consumes a token if one is available. Otherwise it returns
+// the time until the next token becomes available.
+func (b *tokenBucket) take(now time.Time, rps float64, burst int) (ok bool, wait time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rps)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rps * float64(time.Second))
+}
+
+// takeToken consumes a token from the bucket of the client at ip in m,
+// creating a full bucket for a new client. See tokenBucket.take.
+func takeToken(m *sync.Map, ip string, now time.Time, rps float64, burst int) (ok bool, wait time.Duration) {
+	if last := atomic.LoadInt64(&lastSweep); now.UnixNano()-last > int64(bucketSweep) &&
+		atomic.CompareAndSwapInt64(&lastSweep, last, now.UnixNano()) {
+		sweepBuckets(&buckets, now, config.RateLimitRPS, config.RateLimitBurst)
+		sweepBuckets(&reactionBuckets, now, reactionRPS, reactionBurst)
+		sweepBuckets(&reactionReadBuckets, now, reactionReadRPS, reactionReadBurst)
+	}
+	v, _ := m.LoadOrStore(ip, &tokenBucket{tokens: float64(burst), last: now})
+	return v.(*tokenBucket).take(now, rps, burst)
+}
+
+// sweepBuckets deletes the buckets in m that have been idle long enough to refill.
+// Such a bucket is no different from the full one a returning client gets.
+func sweepBuckets(m *sync.Map, now time.Time, rps float64, burst int) {
+	if rps <= 0 {
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	idle := time.Duration(float64(burst) / rps * float64(time.Second))
+	m.Range(func(k, v interface{}) bool {
+		b := v.(*tokenBucket)
+		b.Lock()
+		if now.Sub(b.last) >= idle {
+			m.Delete(k)
+		}
+		b.Unlock()
+		return true
+	})
+}
+
+// rateLimit reports whether req is within the client's rate limit.
+// If it is not, rateLimit replies with 429 Too Many Requests.
+func rateLimit(w http.ResponseWriter, req *http.Request) bool {
+	if config.RateLimitRPS <= 0 {
+		return true
+	}
+	burst := config.RateLimitBurst
+	if burst < 1 {
+		burst = 1
+	}
+	ok, wait := takeToken(&buckets, clientIP(req), time.Now(), config.RateLimitRPS, burst)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+// clientIP returns the address of the client that issued req.
+// Behind the AppEngine front ends, this is the last X-Forwarded-For entry,
+// the one the front end appended: earlier entries come from the client.
+// Elsewhere the header is not trusted at all.
+func clientIP(req *http.Request) string {
+	if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" && onAppEngine() {
+		hops := strings.Split(fwd, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,132 @@
+package post
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/rsc/appfs/fs"
+)
+
+// Reactions are kept in reactions/{post}.json, outside the cache root,
+// so that counting one invalidates no cached page. {post} is the name
+// of the post relative to the posts directory, e.g. "2024/foo".
+// The counts in cached pages are those of their render; pages refresh
+// them from /api/react.
+
+// reactionEmoji is the set of emoji readers may react with.
+var reactionEmoji = map[string]bool{
+	"👍": true, "👎": true, "😄": true, "🎉": true,
+	"😕": true, "❤️": true, "🚀": true, "👀": true,
+}
+
+// reactionBuckets and reactionReadBuckets map client IP addresses
+// to the *tokenBucket limiting their reactions and count lookups.
+var reactionBuckets, reactionReadBuckets sync.Map
+
+// Each client may react 5 times in a row, then once every 10 seconds,
+// and look up counts 30 times in a row, then once a second.
+const (
+	reactionRPS       = 0.1
+	reactionBurst     = 5
+	reactionReadRPS   = 1
+	reactionReadBurst = 30
+)
+
+// reactionsMu serializes the read-modify-write of reaction files within an instance.
+var reactionsMu sync.Mutex
+
+// reactionName returns the name of the post name relative to the posts directory.
+// name may be given relative to the posts directory, or as its blogcache or URL name.
+func reactionName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+postName(name)), "/")
+	return strings.TrimPrefix(name, strings.Trim(postsDir(), "/")+"/")
+}
+
+func reactionsPath(name string) string {
+	return path.Join("reactions", reactionName(name)+".json")
+}
+
+// loadReactions returns the reaction counts of the post name, or nil if there are none.
+func loadReactions(c *fs.Context, name string) map[string]int {
+	data, _, err := c.Read(reactionsPath(name))
+	if err != nil {
+		return nil
+	}
+	var r map[string]int
+	if err := json.Unmarshal(data, &r); err != nil {
+		c.Criticalf("unmarshal reactions of %s: %v", name, err)
+		return nil
+	}
+	return r
+}
+
+// publishedPost reports whether the blogcache lists the post name,
+// relative to the posts directory, as published.
+func publishedPost(c *fs.Context, name string) bool {
+	for n, meta := range readPostCache(c) {
+		if reactionName(n) == name {
+			return !meta.IsDraft()
+		}
+	}
+	return false
+}
+
+// apireact replies with the reaction counts of post as JSON.
+// A POST also counts the reaction emoji first.
+func apireact(w http.ResponseWriter, req *http.Request) {
+	if !cors(w, req) {
+		return
+	}
+	if req.Method != "GET" && req.Method != "POST" {
+		http.Error(w, "react requires GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	post := req.Method == "POST"
+	name, emoji := reactionName(req.FormValue("post")), req.FormValue("emoji")
+	if post && !reactionEmoji[emoji] {
+		http.Error(w, "bad emoji", http.StatusBadRequest)
+		return
+	}
+	m, rps, burst := &reactionReadBuckets, float64(reactionReadRPS), reactionReadBurst
+	if post {
+		m, rps, burst = &reactionBuckets, reactionRPS, reactionBurst
+	}
+	if ok, _ := takeToken(m, clientIP(req), time.Now(), rps, burst); !ok {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	c := fs.NewContext(req)
+	if !publishedPost(c, name) {
+		http.Error(w, "no such post", http.StatusNotFound)
+		return
+	}
+
+	if post {
+		reactionsMu.Lock()
+		defer reactionsMu.Unlock()
+	}
+	r := loadReactions(c, name)
+	if r == nil {
+		r = map[string]int{}
+	}
+	if post {
+		r[emoji]++
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	if post {
+		if err := c.Write(reactionsPath(name), data); err != nil {
+			http.Error(w, "ERROR: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,130 @@
+package post
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"code.google.com/p/rsc/appfs/fs"
+)
+
+// relatedPosts returns the published posts in postCache sharing at least one tag with meta,
+// ordered by the number of shared tags and then chronologically,
+// up to Config.RelatedPostsCount of them.
+func relatedPosts(meta *PostData, postCache map[string]*PostData) []*PostData {
+	if len(meta.Tags) == 0 {
+		return nil
+	}
+	n := config.RelatedPostsCount
+	if n == 0 {
+		n = 3
+	}
+
+	var r byShared
+	for _, p := range postCache {
+		// Posts are keyed by their path in the posts directory, while meta.Name is a URL path.
+		if path.Base(p.Name) == path.Base(meta.Name) || p.IsDraft() || p.NotInTOC {
+			continue
+		}
+		shared := 0
+		for _, t := range meta.Tags {
+			if p.hasTag(t) {
+				shared++
+			}
+		}
+		if shared > 0 {
+			r.posts = append(r.posts, p)
+			r.shared = append(r.shared, shared)
+		}
+	}
+	sort.Sort(&r)
+	if len(r.posts) > n {
+		r.posts = r.posts[:n]
+	}
+	return r.posts
+}
+
+// byShared orders posts by their number of shared tags, most first, then chronologically.
+type byShared struct {
+	posts  []*PostData
+	shared []int
+}
+
+func (x *byShared) Len() int { return len(x.posts) }
+func (x *byShared) Swap(i, j int) {
+	x.posts[i], x.posts[j] = x.posts[j], x.posts[i]
+	x.shared[i], x.shared[j] = x.shared[j], x.shared[i]
+}
+func (x *byShared) Less(i, j int) bool {
+	if x.shared[i] != x.shared[j] {
+		return x.shared[i] > x.shared[j]
+	}
+	return byTime(x.posts).Less(i, j)
+}
+
+// postURLName returns the URL path of the post name, e.g. "/blog/post/foo" for
+// the blogcache entry "blog/post/foo" as well as for the served name "/blog/post/foo".
+func postURLName(name string) string {
+	return path.Join("/", name)
+}
+
+// postRef returns the URL path of the post referenced by PrevName or NextName,
+// given relative to the posts directory ("foo") or as a URL path ("/blog/post/foo").
+func postRef(ref string) string {
+	name := strings.TrimPrefix(path.Join("/", ref), "/")
+	if !strings.HasPrefix(name, postsDir()+"/") {
+		name = path.Join(postsDir(), name)
+	}
+	return "/" + name
+}
+
+// neighbors returns the posts before and after meta.
+// PrevName and NextName take precedence; otherwise the chronological neighbors
+// among the published posts in postCache are used.
+func neighbors(meta *PostData, postCache map[string]*PostData) (prev, next *PostData) {
+	byName := map[string]*PostData{}
+	var published []*PostData
+	for _, p := range postCache {
+		byName[postURLName(p.Name)] = p
+		if !p.IsDraft() && !p.NotInTOC {
+			published = append(published, p)
+		}
+	}
+	sort.Sort(byTime(published)) // Most recent first
+
+	self := postURLName(meta.Name)
+	for i, p := range published {
+		if postURLName(p.Name) != self {
+			continue
+		}
+		if i+1 < len(published) {
+			prev = published[i+1]
+		}
+		if i > 0 {
+			next = published[i-1]
+		}
+		break
+	}
+	if meta.PrevName != "" {
+		prev = byName[postRef(meta.PrevName)]
+	}
+	if meta.NextName != "" {
+		next = byName[postRef(meta.NextName)]
+	}
+	return prev, next
+}
+
+// checkSeriesLinks logs the PrevName and NextName references to posts that do not exist.
+func checkSeriesLinks(c *fs.Context, posts []*PostData) {
+	names := map[string]bool{}
+	for _, p := range posts {
+		names[postURLName(p.Name)] = true
+	}
+	for _, p := range posts {
+		for _, ref := range []string{p.PrevName, p.NextName} {
+			if ref != "" && !names[postRef(ref)] {
+				c.Criticalf("%s: dangling series reference %q", p.Name, ref)
+			}
+		}
+	}
+}
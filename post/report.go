@@ -0,0 +1,47 @@
+package post
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// PanicReport is the JSON payload posted to Config.ErrorReportingURL for a recovered panic.
+type PanicReport struct {
+	Error     string    `json:"error"`
+	Stack     string    `json:"stack"`
+	Path      string    `json:"path"`
+	User      string    `json:"user"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// reportTimeout caps the time spent posting a panic report;
+// reports are best-effort and not retried.
+const reportTimeout = 2 * time.Second
+
+// reportPanic posts payload to url on behalf of ctx.
+func reportPanic(ctx context.Context, url string, payload PanicReport) error {
+	data, err := json.Marshal(&payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error reporting: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package post
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// onAppEngine reports whether the blog runs on AppEngine, which owns the server lifecycle.
+func onAppEngine() bool {
+	return os.Getenv("GAE_APPLICATION") != ""
+}
+
+// listenAndServe serves http.DefaultServeMux on addr until SIGTERM or SIGINT,
+// then lets in-flight requests finish for up to Config.ShutdownTimeout.
+func listenAndServe(addr string) error {
+	srv := &http.Server{Addr: addr, Handler: http.DefaultServeMux}
+
+	done := make(chan error, 1)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		log.Printf("blog: %v, shutting down", <-sig)
+
+		timeout := config.ShutdownTimeout
+		if timeout == 0 {
+			timeout = 30 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-done
+}
@@ -0,0 +1,190 @@
+package post
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Markers delimiting article text exempt from the replacer,
+// e.g. code samples whose quotes must be left alone.
+const (
+	noreplaceBegin = "<!--noreplace-->"
+	noreplaceEnd   = "<!--/noreplace-->"
+)
+
+// replaceText applies the replacer to article, except for the blocks
+// enclosed in noreplace markers, which are copied verbatim.
+func replaceText(article string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(article, noreplaceBegin)
+		if i < 0 {
+			break
+		}
+		j := strings.Index(article[i:], noreplaceEnd)
+		if j < 0 { // Unterminated block: replace the rest as usual
+			break
+		}
+		j += i + len(noreplaceEnd)
+		b.WriteString(replacer.Replace(article[:i]))
+		b.WriteString(article[i:j])
+		article = article[j:]
+	}
+	b.WriteString(replacer.Replace(article))
+	return b.String()
+}
+
+// stripTags returns the text of the HTML fragment s with all tags removed.
+func stripTags(s string) string {
+	var b strings.Builder
+	inTag := false
+	for _, r := range s {
+		switch {
+		case r == '<':
+			inTag = true
+			b.WriteByte(' ')
+		case r == '>' && inTag:
+			inTag = false
+		case !inTag:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// countStats fills in the content statistics of meta from the post article.
+func countStats(meta *PostData, article string) {
+	text := stripTags(article)
+	meta.WordCount = len(strings.Fields(text))
+	meta.CharCount = utf8.RuneCountInString(text)
+	// Count <pre> and <code> blocks, once for the common <pre><code> pair.
+	meta.CodeBlockCount = strings.Count(article, "<pre") + strings.Count(article, "<code") - strings.Count(article, "<pre><code")
+}
+
+// TocEntry is a heading of the in-article table of contents.
+type TocEntry struct {
+	Level  int    // 2 or 3
+	Text   string // Heading text
+	Anchor string // id of the heading element
+}
+
+var (
+	headingRE = regexp.MustCompile(`(?is)<h([23])([^>]*)>(.*?)</h[23]>`)
+	idAttrRE  = regexp.MustCompile(`(?i)\bid\s*=\s*["']([^"']*)["']`)
+)
+
+// headingTOC builds the table of contents of the <h2> and <h3> headings in article.
+// Headings without an id attribute receive one derived from their text.
+// It returns the table and the article with the ids in place.
+func headingTOC(article string) ([]TocEntry, string) {
+	var toc []TocEntry
+	used := map[string]bool{}
+	article = headingRE.ReplaceAllStringFunc(article, func(h string) string {
+		m := headingRE.FindStringSubmatch(h)
+		level, attrs, inner := int(m[1][0]-'0'), m[2], m[3]
+		text := html.UnescapeString(strings.Join(strings.Fields(stripTags(inner)), " "))
+		if id := idAttrRE.FindStringSubmatch(attrs); id != nil {
+			used[id[1]] = true
+			toc = append(toc, TocEntry{Level: level, Text: text, Anchor: id[1]})
+			return h
+		}
+		anchor := slugify(text)
+		for i := 2; used[anchor]; i++ {
+			anchor = fmt.Sprintf("%s-%d", slugify(text), i)
+		}
+		used[anchor] = true
+		toc = append(toc, TocEntry{Level: level, Text: text, Anchor: anchor})
+		return fmt.Sprintf(`<h%d id="%s"%s>%s</h%d>`, level, anchor, attrs, inner, level)
+	})
+	return toc, article
+}
+
+// slugify turns heading text into an anchor name: lower case letters
+// and digits, with runs of anything else collapsed into single dashes.
+func slugify(text string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	if b.Len() == 0 {
+		return "section"
+	}
+	return b.String()
+}
+
+var (
+	imgRE     = regexp.MustCompile(`(?i)<img\b[^>]*>`)
+	srcAttrRE = regexp.MustCompile(`(?i)\bsrc\s*=\s*["']([^"']*)["']`)
+	altAttrRE = regexp.MustCompile(`(?i)\balt\s*=`)
+)
+
+// imageAlt adds alt attributes to the <img> tags of article lacking one,
+// taking the text from alts by the file name of the image source.
+// It returns the sources of the images left without alt text.
+func imageAlt(article string, alts map[string]string) (string, []string) {
+	var missing []string
+	article = imgRE.ReplaceAllStringFunc(article, func(img string) string {
+		if altAttrRE.MatchString(img) {
+			return img
+		}
+		m := srcAttrRE.FindStringSubmatch(img)
+		if m == nil {
+			return img
+		}
+		alt, ok := alts[path.Base(m[1])]
+		if !ok {
+			missing = append(missing, m[1])
+			return img
+		}
+		return fmt.Sprintf(`<img alt="%s"`, html.EscapeString(alt)) + img[len("<img"):]
+	})
+	return article, missing
+}
+
+// Footnote is a footnote of an article, defined by a "[^id]: text" line.
+type Footnote struct {
+	ID   string
+	Text template.HTML // Article HTML, like the rest of the article
+}
+
+var (
+	footnoteDefRE = regexp.MustCompile(`(?m)^\[\^([^\]\s]+)\]:[ \t]*(.*)\n?`)
+	footnoteRefRE = regexp.MustCompile(`\[\^([^\]\s]+)\]`)
+)
+
+// footnotes removes the footnote definitions from article and links its
+// "[^id]" references to them. It returns the footnotes in order of definition.
+func footnotes(article string) ([]Footnote, string) {
+	var notes []Footnote
+	defined := map[string]bool{}
+	article = footnoteDefRE.ReplaceAllStringFunc(article, func(def string) string {
+		m := footnoteDefRE.FindStringSubmatch(def)
+		notes = append(notes, Footnote{ID: m[1], Text: template.HTML(strings.TrimSpace(m[2]))})
+		defined[m[1]] = true
+		return ""
+	})
+	article = footnoteRefRE.ReplaceAllStringFunc(article, func(ref string) string {
+		id := footnoteRefRE.FindStringSubmatch(ref)[1]
+		if !defined[id] {
+			return ref
+		}
+		id = html.EscapeString(id)
+		return fmt.Sprintf(`<sup><a id="fnref-%s" href="#fn-%s">%s</a></sup>`, id, id, id)
+	})
+	return notes, article
+}